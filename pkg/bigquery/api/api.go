@@ -14,11 +14,12 @@ import (
 )
 
 type API struct {
-	Client *bq.Client
+	Client        *bq.Client
+	queryPriority bq.QueryPriority
 }
 
 func New(client *bq.Client) *API {
-	return &API{client}
+	return &API{Client: client}
 }
 
 func (a *API) ListDatasets(ctx context.Context) ([]string, error) {
@@ -93,6 +94,10 @@ func (a *API) SetLocation(location string) {
 	a.Client.Location = location
 }
 
+func (a *API) SetQueryPriority(priority string) {
+	a.queryPriority = bq.QueryPriority(priority)
+}
+
 type ValidateQueryResponse struct {
 	IsValid    bool              `json:"isValid"`
 	IsError    bool              `json:"isError"`
@@ -103,21 +108,33 @@ type ValidateQueryResponse struct {
 
 func (a *API) ValidateQuery(ctx context.Context, query string) *ValidateQueryResponse {
 	q := a.Client.Query(query)
-	q.DryRun = true
-	job, err := q.Run(ctx)
+	q.Priority = a.queryPriority
+	statistics, err := DryRun(ctx, q)
 	response := &ValidateQueryResponse{}
 
-	backend.Logger.Debug("Validating query", "job", job, "err", err, "query", query)
+	backend.Logger.Debug("Validating query", "statistics", statistics, "err", err, "query", query)
 
 	if err != nil {
 		response.IsError = true
 		response.Error = err.Error()
 	} else {
-		status := job.LastStatus()
 		response.IsValid = true
-		response.Statistics = status.Statistics
+		response.Statistics = statistics
 	}
 	response.Query = query
 
 	return response
 }
+
+// DryRun validates the query without running it and returns the statistics BigQuery
+// estimates for it, such as the number of bytes the query would process.
+func DryRun(ctx context.Context, q *bq.Query) (*bq.JobStatistics, error) {
+	dryRun := *q
+	dryRun.DryRun = true
+	job, err := dryRun.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return job.LastStatus().Statistics, nil
+}
@@ -5,10 +5,14 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	bq "cloud.google.com/go/bigquery"
+	storage "cloud.google.com/go/bigquery/storage/apiv1"
 	"github.com/grafana/grafana-google-sdk-go/pkg/utils"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
@@ -33,27 +37,33 @@ type BigqueryDatasourceIface interface {
 	Datasets(ctx context.Context, args DatasetsArgs) ([]string, error)
 	TableSchema(ctx context.Context, args TableSchemaArgs) (*types.TableMetadataResponse, error)
 	ValidateQuery(ctx context.Context, args ValidateQueryArgs) (*api.ValidateQueryResponse, error)
-	Projects(options ProjectsArgs) ([]*Project, error)
+	Projects(ctx context.Context, options ProjectsArgs) ([]*Project, error)
 }
 
+// conn is a cached pool of connections, its connector owns the BigQuery clients of the connections
 type conn struct {
-	db     *sql.DB
-	driver *driver.Driver
+	db *sql.DB
 }
 
 type bqServiceFactory func(ctx context.Context, projectID string, opts ...option.ClientOption) (*bq.Client, error)
 
+type readClientFactory func(ctx context.Context, opts ...option.ClientOption) (driver.ReadClient, error)
+
 type BigQueryDatasource struct {
 	connections             sync.Map
 	apiClients              sync.Map
 	bqFactory               bqServiceFactory
-	resourceManagerServices map[string]*cloudresourcemanager.Service
+	readFactory             readClientFactory
+	projectsCache           sync.Map
+	resourceManagerServices resourceManagerServices
 }
 
 type ConnectionArgs struct {
-	Dataset  string `json:"dataset,omitempty"`
-	Table    string `json:"table,omitempty"`
-	Location string `json:"location,omitempty"`
+	Dataset        string `json:"dataset,omitempty"`
+	Table          string `json:"table,omitempty"`
+	Location       string `json:"location,omitempty"`
+	MaxBytesBilled int64  `json:"maxBytesBilled,omitempty"`
+	UnnestArrays   string `json:"unnestArrays,omitempty"`
 }
 
 func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
@@ -63,14 +73,151 @@ func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSetti
 	ds.EnableMultipleConnections = true
 	ds.CustomRoutes = newResourceHandler(s).Routes()
 
-	return ds.NewDatasource(ctx, settings)
+	i, err := ds.NewDatasource(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	if sqlDatasource, ok := i.(*sqlds.SQLDatasource); ok {
+		return &instance{SQLDatasource: sqlDatasource, datasource: s}, nil
+	}
+	return i, nil
+}
+
+// instance wraps the sqlds data source to label query jobs with the request they were run for,
+// to attach the notices raised by the driver while reading results and the statistics of scripts
+// to the response frames and to fill the frames of the results read with the Storage Read API.
+// Once disposed, it closes the BigQuery clients along with the sqlds connections.
+type instance struct {
+	*sqlds.SQLDatasource
+	datasource *BigQueryDatasource
+}
+
+func (i *instance) Dispose() {
+	i.SQLDatasource.Dispose()
+	i.datasource.Dispose()
+}
+
+func (i *instance) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	ctx, notices := driver.WithNotices(driver.WithJobLabels(ctx, requestJobLabels(req)))
+	ctx, frames := driver.WithFrames(ctx)
+	ctx, scriptStats := driver.WithScriptStats(ctx)
+	res, err := i.SQLDatasource.QueryData(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fillStorageFrames(req, res, frames.For); err != nil {
+		return nil, err
+	}
+	appendNotices(res, notices.For)
+	appendScriptStats(res, scriptStats.For)
+	return res, nil
+}
+
+// fillStorageFrames replaces the fields of the frames of results read with the Storage Read API, which
+// the driver returned no rows for, with the fields read from the Arrow record batches. Time series are
+// converted to the wide format, as sqlds would have done had the rows been returned. framesFor returns
+// the frame read for an executed query string, nil if its result was read through the rows.
+func fillStorageFrames(req *backend.QueryDataRequest, res *backend.QueryDataResponse, framesFor func(query string) *data.Frame) error {
+	for _, q := range req.Queries {
+		response, ok := res.Responses[q.RefID]
+		if !ok {
+			continue
+		}
+
+		for n, frame := range response.Frames {
+			if frame.Meta == nil {
+				continue
+			}
+			storageFrame := framesFor(frame.Meta.ExecutedQueryString)
+			if storageFrame == nil {
+				continue
+			}
+			frame.Fields = storageFrame.Fields
+
+			query, err := sqlutil.GetQuery(q)
+			if err != nil {
+				return err
+			}
+			if query.Format != sqlutil.FormatOptionTimeSeries || frame.TimeSeriesSchema().Type != data.TimeSeriesTypeLong {
+				continue
+			}
+
+			fillMode := query.FillMissing
+			if fillMode == nil {
+				fillMode = &data.FillMissing{Mode: data.FillModeNull}
+			}
+			wide, err := data.LongToWide(frame, fillMode)
+			if err != nil {
+				return err
+			}
+			wide.Name = frame.Name
+			wide.Meta = frame.Meta
+			response.Frames[n] = wide
+		}
+	}
+	return nil
+}
+
+// appendNotices attaches the notices of each query to the frames it was executed for
+func appendNotices(res *backend.QueryDataResponse, noticesFor func(query string) []data.Notice) {
+	for _, response := range res.Responses {
+		for _, frame := range response.Frames {
+			if frame.Meta == nil {
+				continue
+			}
+			frame.AppendNotices(noticesFor(frame.Meta.ExecutedQueryString)...)
+		}
+	}
+}
+
+// appendScriptStats attaches the statistics of the statements of each script to the frames it was executed for
+func appendScriptStats(res *backend.QueryDataResponse, statsFor func(query string) []data.QueryStat) {
+	for _, response := range res.Responses {
+		for _, frame := range response.Frames {
+			if frame.Meta == nil {
+				continue
+			}
+			frame.Meta.Stats = append(frame.Meta.Stats, statsFor(frame.Meta.ExecutedQueryString)...)
+		}
+	}
+}
+
+// requestJobLabels identifies the Grafana data source, dashboard, panel, organization and user a query is run for
+func requestJobLabels(req *backend.QueryDataRequest) map[string]string {
+	labels := map[string]string{}
+	if req.PluginContext.DataSourceInstanceSettings != nil {
+		labels["grafana_datasource_uid"] = req.PluginContext.DataSourceInstanceSettings.UID
+	}
+	if req.PluginContext.OrgID != 0 {
+		labels["grafana_org_id"] = strconv.FormatInt(req.PluginContext.OrgID, 10)
+	}
+	if req.PluginContext.User != nil && req.PluginContext.User.Login != "" {
+		labels["grafana_user"] = req.PluginContext.User.Login
+	}
+	if dashboardUID := req.GetHTTPHeader("X-Dashboard-Uid"); dashboardUID != "" {
+		labels["grafana_dashboard_uid"] = dashboardUID
+	}
+	if panelID := req.GetHTTPHeader("X-Panel-Id"); panelID != "" {
+		labels["grafana_panel_id"] = panelID
+	}
+	return labels
 }
 
 func newBigQueryDatasource() *BigQueryDatasource {
 	return &BigQueryDatasource{
-		bqFactory:               bq.NewClient,
-		resourceManagerServices: make(map[string]*cloudresourcemanager.Service),
+		bqFactory:   bq.NewClient,
+		readFactory: newReadClient,
+	}
+}
+
+func newReadClient(ctx context.Context, opts ...option.ClientOption) (driver.ReadClient, error) {
+	client, err := storage.NewBigQueryReadClient(ctx, opts...)
+	if err != nil {
+		return nil, err
 	}
+	return client, nil
 }
 
 func (s *BigQueryDatasource) Connect(ctx context.Context, config backend.DataSourceInstanceSettings, queryArgs json.RawMessage) (*sql.DB, error) {
@@ -96,9 +243,15 @@ func (s *BigQueryDatasource) Connect(ctx context.Context, config backend.DataSou
 		connectionSettings.Project = defaultProject
 	}
 
-	connectionKey := fmt.Sprintf("%d/%s:%s", config.ID, connectionSettings.Location, connectionSettings.Project)
+	if connectionSettings.JobProject == "" {
+		connectionSettings.JobProject = connectionSettings.Project
+	}
 
-	if s.resourceManagerServices[fmt.Sprint(config.ID)] == nil {
+	s.evictStale(config.ID, config.Updated)
+	apiKey := clientKey(config.ID, config.Updated, connectionSettings.Location, connectionSettings.Project)
+	connectionKey := getConnectionKey(apiKey, connectionSettings, settings)
+
+	if s.resourceManagerServices.get(fmt.Sprint(config.ID), config.Updated) == nil {
 		err := createResourceManagerService(ctx, config, settings, fmt.Sprint(config.ID), s)
 		if err != nil {
 			return nil, err
@@ -110,57 +263,131 @@ func (s *BigQueryDatasource) Connect(ctx context.Context, config backend.DataSou
 		return nil, err
 	}
 
-	c, exists := s.connections.Load(connectionKey)
+	if c, exists := s.connections.Load(connectionKey); exists {
+		log.DefaultLogger.Debug("Reusing existing connection to BigQuery")
+		return c.(conn).db, nil
+	}
+	log.DefaultLogger.Debug("Creating new connection to BigQuery")
 
-	if exists {
-		connection := c.(conn)
-		if !connection.driver.Closed() {
-			log.DefaultLogger.Debug("Reusing existing connection to BigQuery")
-			return connection.db, nil
-		}
-	} else {
-		log.DefaultLogger.Debug("Creating new connection to BigQuery")
+	readClient, err := s.createReadClient(settings, connectionSettings)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to create BigQuery Storage read client")
 	}
 
-	aC, exists := s.apiClients.Load(connectionKey)
+	// The connector owns its client and closes it with the pool, so the client isn't shared with the API
+	// clients or the other connections. Jobs run in the job project, a flat-rate project if configured.
+	client, err := newHTTPClient(settings, opts, bigQueryRoute)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to create http client")
+	}
 
-	// If we have already instantiated API client for given connection details then reuse it's underlying big query
-	// client for db connection.
-	if exists {
-		dr, db, err := driver.Open(connectionSettings, aC.(*api.API).Client)
-		if err != nil {
-			return nil, errors.WithMessage(err, "Failed to connect to database")
-		}
-		s.connections.Store(connectionKey, conn{db: db, driver: dr})
-		return db, nil
-	} else {
-		client, err := newHTTPClient(settings, opts, bigQueryRoute)
-		if err != nil {
-			return nil, errors.WithMessage(err, "Failed to create http client")
-		}
+	bqClient, err := s.bqFactory(context.Background(), connectionSettings.JobProject, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to create BigQuery client")
+	}
+	bqClient.Location = connectionSettings.Location
 
-		bqClient, err := s.bqFactory(context.Background(), connectionSettings.Project, option.WithHTTPClient(client))
-		if err != nil {
-			return nil, errors.WithMessage(err, "Failed to create BigQuery client")
+	db := driver.OpenDB(connectionSettings, bqClient, readClient)
+	// Concurrent queries may have created a pool for the same key in the meantime. The first one stored is
+	// used, the others are closed along with their clients.
+	if c, loaded := s.connections.LoadOrStore(connectionKey, conn{db: db}); loaded {
+		if err := db.Close(); err != nil {
+			log.DefaultLogger.Warn("Failed to close connection to BigQuery", "key", connectionKey, "err", err)
 		}
+		return c.(conn).db, nil
+	}
+	return db, nil
+}
 
-		dr, db, err := driver.Open(connectionSettings, bqClient)
+// createReadClient creates the client reading large results with the Storage Read API. It is gRPC based,
+// its credentials are a token source rather than the http client. None is created unless a threshold
+// above which results are read with the Storage Read API is configured.
+func (s *BigQueryDatasource) createReadClient(settings types.BigQuerySettings, connectionSettings types.ConnectionSettings) (driver.ReadClient, error) {
+	if connectionSettings.StorageReadRows <= 0 && connectionSettings.StorageReadBytes <= 0 {
+		return nil, nil
+	}
 
-		if err != nil {
-			return nil, errors.WithMessage(err, "Failed to connect to database")
+	tokenSource, err := newTokenSource(settings, bigQueryRoute)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.readFactory(context.Background(), option.WithTokenSource(tokenSource))
+}
+
+// clientKey identifies the API client of a data source for a location and project, and is the base of the
+// keys of its connections. The time the settings of the data source were updated is part of the key, so
+// that clients aren't reused once the credentials changed.
+func clientKey(id int64, updated time.Time, location, project string) string {
+	return fmt.Sprintf("%d@%d/%s:%s", id, updated.UnixMilli(), location, project)
+}
+
+// evictStale closes and removes the connections and API clients of a data source which were created
+// before its settings were last updated
+func (s *BigQueryDatasource) evictStale(id int64, updated time.Time) {
+	datasourcePrefix := fmt.Sprintf("%d@", id)
+	currentPrefix := fmt.Sprintf("%d@%d/", id, updated.UnixMilli())
+	s.evict(func(key string) bool {
+		return strings.HasPrefix(key, datasourcePrefix) && !strings.HasPrefix(key, currentPrefix)
+	})
+}
+
+// evict closes and removes the connections and API clients whose keys match, and the projects listed with them
+func (s *BigQueryDatasource) evict(match func(key string) bool) {
+	s.projectsCache.Range(func(key, _ interface{}) bool {
+		if match(key.(string)) {
+			s.projectsCache.Delete(key)
 		}
-		s.connections.Store(connectionKey, conn{db: db, driver: dr})
+		return true
+	})
 
-		apiInstance := api.New(bqClient)
-		apiInstance.SetLocation(connectionSettings.Location)
+	s.connections.Range(func(key, value interface{}) bool {
+		if !match(key.(string)) {
+			return true
+		}
+		s.connections.Delete(key)
+		log.DefaultLogger.Debug("Closing stale connection to BigQuery", "key", key)
+		if err := value.(conn).db.Close(); err != nil {
+			log.DefaultLogger.Warn("Failed to close connection to BigQuery", "key", key, "err", err)
+		}
+		return true
+	})
 
-		if err != nil {
-			return nil, errors.WithMessage(err, "Failed to create BigQuery API client")
+	s.apiClients.Range(func(key, value interface{}) bool {
+		if !match(key.(string)) {
+			return true
 		}
-		s.apiClients.Store(connectionKey, apiInstance)
-		return db, nil
-	}
+		s.apiClients.Delete(key)
+		log.DefaultLogger.Debug("Closing stale BigQuery API client", "key", key)
+		if err := value.(*api.API).Client.Close(); err != nil {
+			log.DefaultLogger.Warn("Failed to close BigQuery API client", "key", key, "err", err)
+		}
+		return true
+	})
+}
 
+// Dispose closes every connection and API client, once the data source instance is replaced or removed
+func (s *BigQueryDatasource) Dispose() {
+	s.evict(func(string) bool { return true })
+}
+
+// getConnectionKey identifies a cached connection. Settings which change how jobs are created are
+// part of the key, so that queries using different settings don't share a connection.
+func getConnectionKey(apiKey string, connectionSettings types.ConnectionSettings, settings types.BigQuerySettings) string {
+	key := apiKey
+	if connectionSettings.JobProject != connectionSettings.Project {
+		key = fmt.Sprintf("%s/%s", key, connectionSettings.JobProject)
+	}
+	if connectionSettings.Dataset != "" {
+		key = fmt.Sprintf("%s#dataset=%s", key, connectionSettings.Dataset)
+	}
+	if connectionSettings.MaxBytesBilled != settings.MaxBytesBilled {
+		key = fmt.Sprintf("%s#maxBytesBilled=%d", key, connectionSettings.MaxBytesBilled)
+	}
+	if connectionSettings.UnnestArrays != settings.UnnestArrays {
+		key = fmt.Sprintf("%s#unnestArrays=%s", key, connectionSettings.UnnestArrays)
+	}
+	return key
 }
 
 func createResourceManagerService(ctx context.Context, config backend.DataSourceInstanceSettings, settings types.BigQuerySettings, id string, s *BigQueryDatasource) error {
@@ -175,16 +402,35 @@ func createResourceManagerService(ctx context.Context, config backend.DataSource
 	}
 
 	cloudresourcemanagerService, err := cloudresourcemanager.NewService(context.Background(), option.WithHTTPClient(httpClient))
-	s.resourceManagerServices[id] = cloudresourcemanagerService
 	if err != nil {
 		return err
 	}
+	s.resourceManagerServices.set(id, config.Updated, cloudresourcemanagerService)
 
 	return nil
 }
 
 func (s *BigQueryDatasource) Converters() (sc []sqlutil.Converter) {
-	return sc
+	return []sqlutil.Converter{timeConverter}
+}
+
+// timeConverter puts TIME values, scanned as durations since midnight, in the frame as milliseconds
+var timeConverter = sqlutil.Converter{
+	Name:          "TIME converter",
+	InputScanType: reflect.TypeOf(sql.NullInt64{}),
+	InputTypeName: "TIME",
+	FrameConverter: sqlutil.FrameConverter{
+		FieldType: data.FieldTypeNullableFloat64,
+		ConverterFunc: func(in interface{}) (interface{}, error) {
+			v := in.(*sql.NullInt64)
+			if !v.Valid {
+				return (*float64)(nil), nil
+			}
+
+			ms := float64(v.Int64) / float64(time.Millisecond)
+			return &ms, nil
+		},
+	},
 }
 
 func (s *BigQueryDatasource) FillMode() *data.FillMissing {
@@ -276,8 +522,16 @@ func (s *BigQueryDatasource) Columns(ctx context.Context, options sqlds.Options)
 	return apiClient.ListColumns(ctx, args.Dataset, args.Table, isOrderable)
 }
 
+// projectsCacheTTL is how long the projects listed for a data source are reused for
+const projectsCacheTTL = 5 * time.Minute
+
+// ProjectsArgs selects the projects to list. Query is a Resource Manager search query, such as
+// "displayName:prod*", all the projects the credentials can see are listed if it's empty. PageSize
+// is the number of projects fetched per request, every page is fetched whatever its size.
 type ProjectsArgs struct {
 	DatasourceID string `json:"datasourceId"`
+	Query        string `json:"query,omitempty"`
+	PageSize     int64  `json:"pageSize,omitempty"`
 }
 
 type Project struct {
@@ -285,18 +539,67 @@ type Project struct {
 	DisplayName string `json:"displayName"`
 }
 
-func (s *BigQueryDatasource) Projects(options ProjectsArgs) ([]*Project, error) {
-	response, err := s.resourceManagerServices[options.DatasourceID].Projects.Search().Do()
+type cachedProjects struct {
+	projects []*Project
+	expires  time.Time
+}
 
-	if err != nil {
-		return nil, err
+// projectsCacheKey identifies the projects listed for a search. Like the keys of the clients, it starts
+// with the data source ID and the time its settings were updated, so that it is evicted with them.
+func projectsCacheKey(datasourceID string, updated time.Time, query string) string {
+	return fmt.Sprintf("%s@%d/%s", datasourceID, updated.UnixMilli(), query)
+}
+
+// pruneProjects removes the projects whose cache expired, searches which aren't repeated aren't kept
+func (s *BigQueryDatasource) pruneProjects(now time.Time) {
+	s.projectsCache.Range(func(key, value interface{}) bool {
+		if !now.Before(value.(cachedProjects).expires) {
+			s.projectsCache.Delete(key)
+		}
+		return true
+	})
+}
+
+func (s *BigQueryDatasource) Projects(ctx context.Context, options ProjectsArgs) ([]*Project, error) {
+	// The service is created with the connection of the data source, for its current settings
+	var updated time.Time
+	if settings := getDatasourceSettings(ctx); settings != nil {
+		updated = settings.Updated
+	}
+
+	now := time.Now()
+	s.pruneProjects(now)
+	cacheKey := projectsCacheKey(options.DatasourceID, updated, options.Query)
+	if cached, ok := s.projectsCache.Load(cacheKey); ok && now.Before(cached.(cachedProjects).expires) {
+		log.DefaultLogger.Debug("Reusing cached projects")
+		return cached.(cachedProjects).projects, nil
+	}
+
+	service := s.resourceManagerServices.get(options.DatasourceID, updated)
+	if service == nil {
+		return nil, fmt.Errorf("projects of data source %s can't be listed before it is connected, save the data source or run a query first", options.DatasourceID)
 	}
 
-	projects := make([]*Project, 0, len(response.Projects))
-	for _, project := range response.Projects {
-		projects = append(projects, &Project{project.ProjectId, project.DisplayName})
+	call := service.Projects.Search()
+	if options.Query != "" {
+		call = call.Query(options.Query)
+	}
+	if options.PageSize > 0 {
+		call = call.PageSize(options.PageSize)
+	}
+
+	projects := []*Project{}
+	err := call.Pages(ctx, func(response *cloudresourcemanager.SearchProjectsResponse) error {
+		for _, project := range response.Projects {
+			projects = append(projects, &Project{project.ProjectId, project.DisplayName})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	s.projectsCache.Store(cacheKey, cachedProjects{projects: projects, expires: time.Now().Add(projectsCacheTTL)})
 	return projects, nil
 }
 
@@ -345,7 +648,8 @@ func (s *BigQueryDatasource) TableSchema(ctx context.Context, args TableSchemaAr
 
 func (s *BigQueryDatasource) getApi(ctx context.Context, project, location string) (*api.API, error) {
 	datasourceSettings := getDatasourceSettings(ctx)
-	connectionKey := fmt.Sprintf("%d/%s:%s", datasourceSettings.ID, location, project)
+	s.evictStale(datasourceSettings.ID, datasourceSettings.Updated)
+	connectionKey := clientKey(datasourceSettings.ID, datasourceSettings.Updated, location, project)
 	cClient, exists := s.apiClients.Load(connectionKey)
 
 	if exists {
@@ -379,6 +683,7 @@ func (s *BigQueryDatasource) getApi(ctx context.Context, project, location strin
 	} else {
 		apiInstance.SetLocation(settings.ProcessingLocation)
 	}
+	apiInstance.SetQueryPriority(settings.QueryPriority)
 
 	s.apiClients.Store(connectionKey, apiInstance)
 
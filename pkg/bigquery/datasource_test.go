@@ -4,13 +4,19 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	bq "cloud.google.com/go/bigquery"
 	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/api"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
 	"github.com/grafana/grafana-plugin-sdk-go/experimental/datasourcetest"
 	"github.com/grafana/sqlds/v3"
 	"github.com/stretchr/testify/assert"
@@ -36,7 +42,6 @@ func Test_datasourceConnection(t *testing.T) {
 				Location: "test",
 			}, nil
 		},
-		resourceManagerServices: make(map[string]*cloudresourcemanager.Service),
 	}
 
 	t.Run("errors if authentication details are not configured connection", func(t *testing.T) {
@@ -53,7 +58,7 @@ func Test_datasourceConnection(t *testing.T) {
 		_, err := RunConnection(ds, []byte("{}"))
 		assert.Nil(t, err)
 
-		_, exists := ds.connections.Load("1/us-west1:raintank-dev")
+		_, exists := ds.connections.Load(clientKey(1, time.Time{}, "us-west1", "raintank-dev"))
 		assert.True(t, exists)
 	})
 
@@ -61,7 +66,15 @@ func Test_datasourceConnection(t *testing.T) {
 		_, err1 := RunConnection(ds, []byte(`{"location": "us-west2"}`))
 		assert.Nil(t, err1)
 
-		_, exists := ds.connections.Load("1/us-west2:raintank-dev")
+		_, exists := ds.connections.Load(clientKey(1, time.Time{}, "us-west2", "raintank-dev"))
+		assert.True(t, exists)
+	})
+
+	t.Run("creates separate connections for different datasets", func(t *testing.T) {
+		_, err1 := RunConnection(ds, []byte(`{"dataset": "events"}`))
+		assert.Nil(t, err1)
+
+		_, exists := ds.connections.Load(clientKey(1, time.Time{}, "us-west1", "raintank-dev") + "#dataset=events")
 		assert.True(t, exists)
 	})
 
@@ -72,13 +85,13 @@ func Test_datasourceConnection(t *testing.T) {
 		_, err2 := RunConnection(ds, []byte(`{"location": "us-west3"}`))
 		assert.Nil(t, err2)
 
-		_, conn1Exists := ds.connections.Load("1/us-west2:raintank-dev")
+		_, conn1Exists := ds.connections.Load(clientKey(1, time.Time{}, "us-west2", "raintank-dev"))
 		assert.True(t, conn1Exists)
-		_, conn2Exists := ds.connections.Load("1/us-west3:raintank-dev")
+		_, conn2Exists := ds.connections.Load(clientKey(1, time.Time{}, "us-west3", "raintank-dev"))
 		assert.True(t, conn2Exists)
 	})
 
-	t.Run("reuses existing BigQuery client if API exists for given connection details ", func(t *testing.T) {
+	t.Run("creates a BigQuery client of its own even if an API client exists for given connection details", func(t *testing.T) {
 		clientsFactoryCallsCount := 0
 
 		ds := &BigQueryDatasource{
@@ -88,50 +101,101 @@ func Test_datasourceConnection(t *testing.T) {
 					Location: "test",
 				}, nil
 			},
-			resourceManagerServices: make(map[string]*cloudresourcemanager.Service),
 		}
 
-		ds.apiClients.Store("1/us-west2:raintank-dev", api.New(&bq.Client{
-			Location: "us-west1",
-		}))
+		apiClient := &bq.Client{Location: "us-west2"}
+		ds.apiClients.Store(clientKey(1, time.Time{}, "us-west2", "raintank-dev"), api.New(apiClient))
 
 		_, err1 := RunConnection(ds, []byte(`{"location": "us-west2"}`))
 		assert.Nil(t, err1)
 
-		_, exists := ds.connections.Load("1/us-west2:raintank-dev")
+		_, exists := ds.connections.Load(clientKey(1, time.Time{}, "us-west2", "raintank-dev"))
 		assert.True(t, exists)
-		assert.Equal(t, 0, clientsFactoryCallsCount)
-	})
+		assert.Equal(t, 1, clientsFactoryCallsCount)
 
-	t.Run("creates BigQuery client if API does not exists for given connection details ", func(t *testing.T) {
-		clientsFactoryCallsCount := 0
+		stored, _ := ds.apiClients.Load(clientKey(1, time.Time{}, "us-west2", "raintank-dev"))
+		assert.Same(t, apiClient, stored.(*api.API).Client)
+	})
 
+	t.Run("shares one pool between concurrent connections", func(t *testing.T) {
 		ds := &BigQueryDatasource{
 			bqFactory: func(ctx context.Context, projectID string, opts ...option.ClientOption) (*bq.Client, error) {
-				clientsFactoryCallsCount += 1
+				time.Sleep(10 * time.Millisecond)
 				return &bq.Client{
 					Location: "test",
 				}, nil
 			},
-			resourceManagerServices: make(map[string]*cloudresourcemanager.Service),
 		}
 
-		ds.apiClients.Store("1/us-west2:raintank-dev", api.New(&bq.Client{
-			Location: "us-west1",
-		}))
+		dbs := make([]*sql.DB, 5)
+		var wg sync.WaitGroup
+		for i := range dbs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				db, err := RunConnection(ds, []byte(`{}`))
+				assert.NoError(t, err)
+				dbs[i] = db
+			}(i)
+		}
+		wg.Wait()
+
+		stored, exists := ds.connections.Load(clientKey(1, time.Time{}, "us-west1", "raintank-dev"))
+		require.True(t, exists)
+		for _, db := range dbs {
+			assert.Same(t, stored.(conn).db, db)
+		}
+	})
+
+	t.Run("doesn't create API clients for connections", func(t *testing.T) {
+		ds := &BigQueryDatasource{
+			bqFactory: func(ctx context.Context, projectID string, opts ...option.ClientOption) (*bq.Client, error) {
+				return &bq.Client{
+					Location: "test",
+				}, nil
+			},
+		}
 
 		_, err1 := RunConnection(ds, []byte(`{}`))
 		assert.Nil(t, err1)
 
-		_, exists := ds.connections.Load("1/us-west1:raintank-dev")
+		_, exists := ds.connections.Load(clientKey(1, time.Time{}, "us-west1", "raintank-dev"))
 		assert.True(t, exists)
+		_, apiClientExists := ds.apiClients.Load(clientKey(1, time.Time{}, "us-west1", "raintank-dev"))
+		assert.False(t, apiClientExists)
+	})
 
-		_, apiClient1Exists := ds.apiClients.Load("1/us-west2:raintank-dev")
-		assert.True(t, apiClient1Exists)
-		_, apiClient2Exists := ds.apiClients.Load("1/us-west1:raintank-dev")
-		assert.True(t, apiClient2Exists)
+	t.Run("creates a separate client in the flat-rate project for query jobs", func(t *testing.T) {
+		clientProjects := []string{}
 
-		assert.Equal(t, 1, clientsFactoryCallsCount)
+		ds := &BigQueryDatasource{
+			bqFactory: func(ctx context.Context, projectID string, opts ...option.ClientOption) (*bq.Client, error) {
+				clientProjects = append(clientProjects, projectID)
+				return &bq.Client{
+					Location: "test",
+				}, nil
+			},
+		}
+
+		ds.apiClients.Store(clientKey(1, time.Time{}, "us-west1", "raintank-dev"), api.New(&bq.Client{
+			Location: "us-west1",
+		}))
+
+		_, err := ds.Connect(context.Background(), backend.DataSourceInstanceSettings{
+			ID: 1,
+			DecryptedSecureJSONData: map[string]string{
+				"privateKey": "randomPrivateKey",
+			},
+			JSONData: []byte(`{"authenticationType":"jwt","defaultProject": "raintank-dev", "flatRateProject": "raintank-slots", "processingLocation": "us-west1","tokenUri":"token","clientEmail":"test@grafana.com"}`),
+		}, []byte(`{}`))
+		assert.Nil(t, err)
+
+		_, exists := ds.connections.Load(clientKey(1, time.Time{}, "us-west1", "raintank-dev") + "/raintank-slots")
+		assert.True(t, exists)
+		assert.Equal(t, []string{"raintank-slots"}, clientProjects)
+
+		apiClient, _ := ds.apiClients.Load(clientKey(1, time.Time{}, "us-west1", "raintank-dev"))
+		assert.Equal(t, "us-west1", apiClient.(*api.API).Client.Location)
 	})
 
 	t.Run("creates resource manager if doesn't exist for the given datasource", func(t *testing.T) {
@@ -141,14 +205,54 @@ func Test_datasourceConnection(t *testing.T) {
 					Location: "test",
 				}, nil
 			},
-			resourceManagerServices: make(map[string]*cloudresourcemanager.Service),
 		}
 
 		_, err1 := RunConnection(ds, []byte(`{}`))
 		assert.Nil(t, err1)
 
-		_, exists := ds.resourceManagerServices["1"]
-		assert.True(t, exists)
+		assert.NotNil(t, ds.resourceManagerServices.get("1", time.Time{}))
+	})
+
+	t.Run("evicts the connections and API clients of previous settings", func(t *testing.T) {
+		ds := &BigQueryDatasource{
+			bqFactory: func(ctx context.Context, projectID string, opts ...option.ClientOption) (*bq.Client, error) {
+				return &bq.Client{
+					Location: "test",
+				}, nil
+			},
+		}
+		settings := backend.DataSourceInstanceSettings{
+			ID: 1,
+			DecryptedSecureJSONData: map[string]string{
+				"privateKey": "randomPrivateKey",
+			},
+			JSONData: []byte(`{"authenticationType":"jwt","defaultProject": "raintank-dev", "processingLocation": "us-west1","tokenUri":"token","clientEmail":"test@grafana.com"}`),
+			Updated:  time.Unix(1700000000, 0),
+		}
+		ds.apiClients.Store(clientKey(2, time.Time{}, "us-west1", "raintank-dev"), api.New(&bq.Client{}))
+
+		staleDB, err := ds.Connect(context.Background(), settings, []byte(`{}`))
+		require.NoError(t, err)
+
+		settings.Updated = time.Unix(1700000060, 0)
+		_, err = ds.Connect(context.Background(), settings, []byte(`{}`))
+		require.NoError(t, err)
+
+		_, staleConnExists := ds.connections.Load(clientKey(1, time.Unix(1700000000, 0), "us-west1", "raintank-dev"))
+		assert.False(t, staleConnExists)
+		_, staleAPIExists := ds.apiClients.Load(clientKey(1, time.Unix(1700000000, 0), "us-west1", "raintank-dev"))
+		assert.False(t, staleAPIExists)
+		assert.ErrorContains(t, staleDB.Ping(), "database is closed")
+		_, connExists := ds.connections.Load(clientKey(1, time.Unix(1700000060, 0), "us-west1", "raintank-dev"))
+		assert.True(t, connExists)
+		_, otherAPIExists := ds.apiClients.Load(clientKey(2, time.Time{}, "us-west1", "raintank-dev"))
+		assert.True(t, otherAPIExists, "clients of other data sources must be kept")
+
+		ds.Dispose()
+		_, connExists = ds.connections.Load(clientKey(1, time.Unix(1700000060, 0), "us-west1", "raintank-dev"))
+		assert.False(t, connExists)
+		_, otherAPIExists = ds.apiClients.Load(clientKey(2, time.Time{}, "us-west1", "raintank-dev"))
+		assert.False(t, otherAPIExists)
 	})
 }
 
@@ -179,7 +283,7 @@ func Test_getApi(t *testing.T) {
 		_, err := ds.getApi(context.Background(), "raintank-dev", "us-west1")
 		assert.Nil(t, err)
 
-		_, apiConnExists := ds.apiClients.Load("1/us-west1:raintank-dev")
+		_, apiConnExists := ds.apiClients.Load(clientKey(1, time.Time{}, "us-west1", "raintank-dev"))
 		assert.True(t, apiConnExists)
 	})
 
@@ -196,12 +300,12 @@ func Test_getApi(t *testing.T) {
 		}
 		_, err1 := ds.getApi(context.Background(), "raintank-dev", "us-west1")
 		assert.Nil(t, err1)
-		_, apiConn1Exists := ds.apiClients.Load("1/us-west1:raintank-dev")
+		_, apiConn1Exists := ds.apiClients.Load(clientKey(1, time.Time{}, "us-west1", "raintank-dev"))
 		assert.True(t, apiConn1Exists)
 
 		_, err2 := ds.getApi(context.Background(), "raintank-prod", "us-west2")
 		assert.Nil(t, err2)
-		_, apiConn2Exists := ds.apiClients.Load("1/us-west2:raintank-prod")
+		_, apiConn2Exists := ds.apiClients.Load(clientKey(1, time.Time{}, "us-west2", "raintank-prod"))
 		assert.True(t, apiConn2Exists)
 
 		assert.Equal(t, clientsFactoryCallsCount, 2)
@@ -219,7 +323,7 @@ func Test_getApi(t *testing.T) {
 			},
 		}
 
-		ds.apiClients.Store("1/us-west1:raintank-dev", api.New(&bq.Client{
+		ds.apiClients.Store(clientKey(1, time.Time{}, "us-west1", "raintank-dev"), api.New(&bq.Client{
 			Location: "us-west1",
 		}))
 
@@ -230,6 +334,274 @@ func Test_getApi(t *testing.T) {
 
 }
 
+func Test_Projects(t *testing.T) {
+	searches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		searches++
+		assert.Equal(t, "/v3/projects:search", r.URL.Path)
+		assert.Equal(t, "displayName:prod*", r.URL.Query().Get("query"))
+		assert.Equal(t, "2", r.URL.Query().Get("pageSize"))
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("pageToken") == "" {
+			_, _ = w.Write([]byte(`{"projects":[{"projectId":"prod-1","displayName":"prod 1"},{"projectId":"prod-2","displayName":"prod 2"}],"nextPageToken":"page-2"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"projects":[{"projectId":"prod-3","displayName":"prod 3"}]}`))
+	}))
+	defer srv.Close()
+
+	service, err := cloudresourcemanager.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+	ds := &BigQueryDatasource{}
+	ds.resourceManagerServices.set("1", time.Time{}, service)
+
+	args := ProjectsArgs{DatasourceID: "1", Query: "displayName:prod*", PageSize: 2}
+	projects, err := ds.Projects(context.Background(), args)
+	require.NoError(t, err)
+	assert.Equal(t, []*Project{{"prod-1", "prod 1"}, {"prod-2", "prod 2"}, {"prod-3", "prod 3"}}, projects)
+	assert.Equal(t, 2, searches)
+
+	_, err = ds.Projects(context.Background(), args)
+	require.NoError(t, err)
+	assert.Equal(t, 2, searches, "projects must be cached")
+
+	_, err = ds.Projects(context.Background(), ProjectsArgs{DatasourceID: "2"})
+	assert.ErrorContains(t, err, "projects of data source 2 can't be listed before it is connected")
+
+	t.Run("removes expired projects", func(t *testing.T) {
+		ds.projectsCache.Store(projectsCacheKey("1", time.Time{}, "displayName:old*"), cachedProjects{expires: time.Now().Add(-time.Second)})
+		ds.pruneProjects(time.Now())
+		_, expiredExists := ds.projectsCache.Load(projectsCacheKey("1", time.Time{}, "displayName:old*"))
+		assert.False(t, expiredExists)
+		_, exists := ds.projectsCache.Load(projectsCacheKey("1", time.Time{}, "displayName:prod*"))
+		assert.True(t, exists)
+	})
+
+	t.Run("evicts the projects of previous settings", func(t *testing.T) {
+		ds.evictStale(1, time.Unix(1700000000, 0))
+		_, exists := ds.projectsCache.Load(projectsCacheKey("1", time.Time{}, "displayName:prod*"))
+		assert.False(t, exists)
+	})
+}
+
+func Test_resourceManagerServices(t *testing.T) {
+	services := resourceManagerServices{}
+	before, after := time.Unix(1700000000, 0), time.Unix(1700000060, 0)
+	stale, current := &cloudresourcemanager.Service{}, &cloudresourcemanager.Service{}
+
+	services.set("1", before, stale)
+	assert.Same(t, stale, services.get("1", before))
+	assert.Nil(t, services.get("1", after), "a service must not be reused once the settings are updated")
+
+	services.set("1", after, current)
+	assert.Same(t, current, services.get("1", after))
+	assert.Nil(t, services.get("1", before))
+	assert.Nil(t, services.get("10", after))
+}
+
+func Test_requestJobLabels(t *testing.T) {
+	req := &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{
+			OrgID:                      2,
+			User:                       &backend.User{Login: "admin"},
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "bq-ds"},
+		},
+	}
+	req.SetHTTPHeader("X-Dashboard-Uid", "dash-1")
+	req.SetHTTPHeader("X-Panel-Id", "4")
+
+	assert.Equal(t, map[string]string{
+		"grafana_datasource_uid": "bq-ds",
+		"grafana_org_id":         "2",
+		"grafana_user":           "admin",
+		"grafana_dashboard_uid":  "dash-1",
+		"grafana_panel_id":       "4",
+	}, requestJobLabels(req))
+}
+
+func Test_fillStorageFrames(t *testing.T) {
+	ts := time.Unix(1700000000, 0).UTC()
+	sqldsFrame := func(query string) *data.Frame {
+		frame := data.NewFrame("A")
+		frame.Meta = &data.FrameMeta{ExecutedQueryString: query}
+		return frame
+	}
+
+	tests := []struct {
+		name    string
+		format  sqlutil.FormatQueryOption
+		frame   *data.Frame
+		storage map[string]*data.Frame
+		check   func(t *testing.T, frame *data.Frame)
+	}{
+		{
+			name:   "keeps the frames of results read through the rows",
+			format: sqlutil.FormatOptionTable,
+			frame:  data.NewFrame("A", data.NewField("id", nil, []int64{1})).SetMeta(&data.FrameMeta{ExecutedQueryString: "SELECT id FROM t"}),
+			check: func(t *testing.T, frame *data.Frame) {
+				require.Len(t, frame.Fields, 1)
+				assert.Equal(t, int64(1), frame.Fields[0].At(0))
+			},
+		},
+		{
+			name:    "keeps frames without metadata",
+			format:  sqlutil.FormatOptionTable,
+			frame:   data.NewFrame("A"),
+			storage: map[string]*data.Frame{"": data.NewFrame("", data.NewField("id", nil, []int64{1}))},
+			check: func(t *testing.T, frame *data.Frame) {
+				assert.Empty(t, frame.Fields)
+			},
+		},
+		{
+			name:   "fills tables with the fields read with the Storage Read API",
+			format: sqlutil.FormatOptionTable,
+			frame:  sqldsFrame("SELECT id FROM t"),
+			storage: map[string]*data.Frame{
+				"SELECT id FROM t": data.NewFrame("", data.NewField("id", nil, []int64{1, 2, 3})),
+			},
+			check: func(t *testing.T, frame *data.Frame) {
+				assert.Equal(t, "A", frame.Name)
+				assert.Equal(t, "SELECT id FROM t", frame.Meta.ExecutedQueryString)
+				require.Len(t, frame.Fields, 1)
+				assert.Equal(t, 3, frame.Rows())
+			},
+		},
+		{
+			name:   "converts long time series to the wide format",
+			format: sqlutil.FormatOptionTimeSeries,
+			frame:  sqldsFrame("SELECT ts, host, value FROM t"),
+			storage: map[string]*data.Frame{
+				"SELECT ts, host, value FROM t": data.NewFrame("",
+					data.NewField("ts", nil, []time.Time{ts, ts, ts.Add(time.Minute)}),
+					data.NewField("host", nil, []string{"a", "b", "a"}),
+					data.NewField("value", nil, []float64{1, 2, 3}),
+				),
+			},
+			check: func(t *testing.T, frame *data.Frame) {
+				assert.Equal(t, "A", frame.Name)
+				assert.Equal(t, "SELECT ts, host, value FROM t", frame.Meta.ExecutedQueryString)
+				require.Len(t, frame.Fields, 3)
+				assert.Equal(t, 2, frame.Rows())
+				assert.Equal(t, data.Labels{"host": "a"}, frame.Fields[1].Labels)
+				assert.Equal(t, data.Labels{"host": "b"}, frame.Fields[2].Labels)
+				assert.Nil(t, frame.Fields[2].At(1), "missing values are filled with nulls")
+			},
+		},
+		{
+			name:   "keeps wide time series",
+			format: sqlutil.FormatOptionTimeSeries,
+			frame:  sqldsFrame("SELECT ts, value FROM t"),
+			storage: map[string]*data.Frame{
+				"SELECT ts, value FROM t": data.NewFrame("",
+					data.NewField("ts", nil, []time.Time{ts, ts.Add(time.Minute)}),
+					data.NewField("value", nil, []float64{1, 2}),
+				),
+			},
+			check: func(t *testing.T, frame *data.Frame) {
+				require.Len(t, frame.Fields, 2)
+				assert.Equal(t, "value", frame.Fields[1].Name)
+				assert.Equal(t, 2, frame.Rows())
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queryJSON, err := json.Marshal(map[string]interface{}{"format": tt.format})
+			require.NoError(t, err)
+			req := &backend.QueryDataRequest{Queries: []backend.DataQuery{{RefID: "A", JSON: queryJSON}}}
+			res := &backend.QueryDataResponse{Responses: backend.Responses{"A": {Frames: data.Frames{tt.frame}}}}
+
+			err = fillStorageFrames(req, res, func(query string) *data.Frame { return tt.storage[query] })
+			require.NoError(t, err)
+			require.Len(t, res.Responses["A"].Frames, 1)
+			tt.check(t, res.Responses["A"].Frames[0])
+		})
+	}
+}
+
+func Test_appendNotices(t *testing.T) {
+	warning := data.Notice{Severity: data.NoticeSeverityWarning, Text: "values were rounded"}
+
+	tests := []struct {
+		name     string
+		frame    *data.Frame
+		notices  map[string][]data.Notice
+		expected []data.Notice
+	}{
+		{
+			name:     "attaches the notices of the executed query",
+			frame:    data.NewFrame("A").SetMeta(&data.FrameMeta{ExecutedQueryString: "SELECT 1"}),
+			notices:  map[string][]data.Notice{"SELECT 1": {warning}},
+			expected: []data.Notice{warning},
+		},
+		{
+			name:    "ignores the notices of other queries",
+			frame:   data.NewFrame("A").SetMeta(&data.FrameMeta{ExecutedQueryString: "SELECT 2"}),
+			notices: map[string][]data.Notice{"SELECT 1": {warning}},
+		},
+		{
+			name:    "ignores frames without metadata",
+			frame:   data.NewFrame("A"),
+			notices: map[string][]data.Notice{"": {warning}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &backend.QueryDataResponse{Responses: backend.Responses{"A": {Frames: data.Frames{tt.frame}}}}
+			appendNotices(res, func(query string) []data.Notice { return tt.notices[query] })
+
+			var notices []data.Notice
+			if tt.frame.Meta != nil {
+				notices = tt.frame.Meta.Notices
+			}
+			assert.Equal(t, tt.expected, notices)
+		})
+	}
+}
+
+func Test_appendScriptStats(t *testing.T) {
+	bytes := data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Statement 1 bytes processed"}, Value: 100}
+	existing := data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Rows"}, Value: 1}
+
+	tests := []struct {
+		name     string
+		frame    *data.Frame
+		stats    map[string][]data.QueryStat
+		expected []data.QueryStat
+	}{
+		{
+			name:     "appends the statistics of the executed script",
+			frame:    data.NewFrame("A").SetMeta(&data.FrameMeta{ExecutedQueryString: "SELECT 1; SELECT 2", Stats: []data.QueryStat{existing}}),
+			stats:    map[string][]data.QueryStat{"SELECT 1; SELECT 2": {bytes}},
+			expected: []data.QueryStat{existing, bytes},
+		},
+		{
+			name:     "ignores the statistics of other scripts",
+			frame:    data.NewFrame("A").SetMeta(&data.FrameMeta{ExecutedQueryString: "SELECT 3"}),
+			stats:    map[string][]data.QueryStat{"SELECT 1; SELECT 2": {bytes}},
+			expected: nil,
+		},
+		{
+			name:  "ignores frames without metadata",
+			frame: data.NewFrame("A"),
+			stats: map[string][]data.QueryStat{"": {bytes}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &backend.QueryDataResponse{Responses: backend.Responses{"A": {Frames: data.Frames{tt.frame}}}}
+			appendScriptStats(res, func(query string) []data.QueryStat { return tt.stats[query] })
+
+			var stats []data.QueryStat
+			if tt.frame.Meta != nil {
+				stats = tt.frame.Meta.Stats
+			}
+			assert.Equal(t, tt.expected, stats)
+		})
+	}
+}
+
 func TestBigQueryMultiTenancy(t *testing.T) {
 	const (
 		tenantID1 = "abc123"
@@ -336,3 +708,13 @@ func newTestCallResourceResponseSender() *testCallResourceResponseSender {
 func (s *testCallResourceResponseSender) Send(_ *backend.CallResourceResponse) error {
 	return nil
 }
+
+func Test_timeConverter(t *testing.T) {
+	v, err := timeConverter.FrameConverter.ConverterFunc(&sql.NullInt64{Int64: int64(time.Hour + 1500*time.Microsecond), Valid: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3600001.5, *v.(*float64))
+
+	v, err = timeConverter.FrameConverter.ConverterFunc(&sql.NullInt64{})
+	require.NoError(t, err)
+	assert.Nil(t, v.(*float64))
+}
@@ -3,17 +3,16 @@ package driver
 import (
 	"context"
 	"database/sql/driver"
-	"encoding/base64"
 	"fmt"
-	"reflect"
-	"strings"
+	"io"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	bq "cloud.google.com/go/bigquery"
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/api"
 	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
-	"google.golang.org/api/iterator"
 )
 
 type Dataset interface {
@@ -51,108 +50,217 @@ type Dataset interface {
 	Routines(ctx context.Context) *bigquery.RoutineIterator
 }
 
+// jobCancelTimeout bounds the request cancelling a job once the query context is done
+const jobCancelTimeout = 10 * time.Second
+
 type Conn struct {
 	cfg    *types.ConnectionSettings
 	client *bigquery.Client
 	bad    bool
 	closed bool
+	// location is the time zone of DATE and DATETIME values
+	location *time.Location
+	// session is the ID of the BigQuery session of the transaction in progress
+	session string
+	// txErr is the error of a statement that failed in the transaction in progress
+	txErr error
+	// readClient reads large results with the Storage Read API, results are read through the rows if nil
+	readClient ReadClient
+	// storageDenied is set once reading with the Storage Read API was denied, so it isn't tried again.
+	// It is shared by the connections of a connector.
+	storageDenied *atomic.Bool
 }
 
-func namedValueToValue(named []driver.NamedValue) ([]driver.Value, error) {
-	args := make([]driver.Value, len(named))
-	for n, param := range named {
-		if len(param.Name) > 0 {
-			return nil, fmt.Errorf("driver does not support the use of Named Parameters")
+// queryParameters converts database/sql arguments into BigQuery query parameters. Positional
+// arguments bind to `?` placeholders and named arguments (sql.Named) bind to `@name` placeholders.
+func queryParameters(args []driver.NamedValue) ([]bigquery.QueryParameter, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	params := make([]bigquery.QueryParameter, len(args))
+	for n, arg := range args {
+		if (arg.Name == "") != (args[0].Name == "") {
+			return nil, fmt.Errorf("positional and named parameters cannot be mixed in the same query")
 		}
-		args[n] = param.Value
+
+		value := arg.Value
+		if value == nil {
+			// BigQuery requires every parameter to be typed, an untyped NULL is sent as a NULL STRING
+			value = bigquery.NullString{}
+		}
+		params[n] = bigquery.QueryParameter{Name: arg.Name, Value: value}
+	}
+	return params, nil
+}
+
+func valuesToNamedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for n, value := range args {
+		named[n] = driver.NamedValue{Ordinal: n + 1, Value: value}
+	}
+	return named
+}
+
+// CheckNamedValue accepts the database/sql default types as well as BigQuery specific ones
+// such as civil.Date, *big.Rat or slices, which are validated by BigQuery when the job is created.
+func (c *Conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if value, err := driver.DefaultParameterConverter.ConvertValue(nv.Value); err == nil {
+		nv.Value = value
 	}
-	return args, nil
+	return nil
+}
+
+// newQuery creates a query with the given arguments bound as query parameters
+func (c *Conn) newQuery(ctx context.Context, query string, args []driver.NamedValue) (*bigquery.Query, error) {
+	params, err := queryParameters(args)
+	if err != nil {
+		return nil, err
+	}
+
+	q := c.client.Query(query)
+	q.Location = c.client.Location
+	q.Parameters = params
+	q.MaxBytesBilled = c.cfg.MaxBytesBilled
+	q.Labels = jobLabels(ctx, c.cfg.JobLabels)
+	q.ConnectionProperties = c.sessionProperties()
+	if c.cfg.QueryPriority != "" {
+		q.Priority = bigquery.QueryPriority(c.cfg.QueryPriority)
+	}
+	// Unqualified table names resolve against the dataset of the query. The project has to be
+	// set as well, jobs may run in a flat-rate project rather than the project holding the data.
+	// A default project can't be set without a default dataset, the datasets of unqualified
+	// dataset.table names are looked up in the data project through dataset_project_id then.
+	if c.cfg.Dataset != "" {
+		q.DefaultProjectID = c.cfg.Project
+		q.DefaultDatasetID = c.cfg.Dataset
+	} else if c.cfg.JobProject != "" && c.cfg.JobProject != c.cfg.Project {
+		q.ConnectionProperties = append(q.ConnectionProperties, &bigquery.ConnectionProperty{Key: "dataset_project_id", Value: c.cfg.Project})
+	}
+
+	return q, nil
 }
 
-func prepareQuery(query string, args []driver.Value) (out string, err error) {
-	if len(args) > 0 {
-		for _, arg := range args {
-			switch value := arg.(type) {
-			case string:
-				query = strings.Replace(query, "?", fmt.Sprintf("'%s'", value), 1)
-			case int, int64, int8, int32, int16:
-				query = strings.Replace(query, "?", fmt.Sprintf("%d", value), 1)
-			case float32, float64:
-				query = strings.Replace(query, "?", fmt.Sprintf("%f", value), 1)
-			case time.Time:
-				query = strings.Replace(query, "?", fmt.Sprintf("'%s'", value.Format("2006-01-02T15:04:05Z07:00")), 1)
-			case bool:
-				query = strings.Replace(query, "?", fmt.Sprintf("%t", value), 1)
-			case []byte:
-				if len(value) == 0 {
-					query = strings.Replace(query, "?", "NULL", 1)
-				} else {
-					data64 := base64.StdEncoding.EncodeToString(value)
-					query = strings.Replace(query, "?", fmt.Sprintf("FROM_BASE64('%s')", data64), 1)
-				}
-			default:
-				log.DefaultLogger.Info("unknown type: %s", reflect.TypeOf(value).String())
-				query = strings.Replace(query, "?", fmt.Sprintf("'%s'", value), 1)
-			}
+// preflight dry runs the query when a preflight limit is configured, and refuses queries which
+// are estimated to process more bytes than the limit before anything gets billed.
+func (c *Conn) preflight(ctx context.Context, q *bigquery.Query) error {
+	if c.cfg.PreflightBytesLimit <= 0 {
+		return nil
+	}
+
+	statistics, err := api.DryRun(ctx, q)
+	if err != nil {
+		return err
+	}
 
+	if statistics.TotalBytesProcessed > c.cfg.PreflightBytesLimit {
+		return &PreflightLimitError{EstimatedBytes: statistics.TotalBytesProcessed, Limit: c.cfg.PreflightBytesLimit}
+	}
+
+	return nil
+}
+
+// runJob starts the query job and waits for it to finish. Batch jobs may stay queued for a
+// while, the wait lasts until the job is done or the request context is. If the request
+// context is done first, the job is cancelled so it stops billing. Scripts which fail
+// return a ScriptError telling which of their statements failed.
+func (c *Conn) runJob(ctx context.Context, q *bigquery.Query) (job *bigquery.Job, status *bigquery.JobStatus, err error) {
+	if c.txErr != nil {
+		return nil, nil, fmt.Errorf("a statement of the transaction failed, it has to be rolled back: %w", c.txErr)
+	}
+	defer func() {
+		if err != nil && c.session != "" {
+			c.txErr = err
 		}
-		out = query
+	}()
+
+	job, err = q.Run(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the named job is reset when returning, the cancellation uses a copy of it
+	started := job
+	stop := context.AfterFunc(ctx, func() {
+		cancelJob(started)
+	})
+	defer stop()
 
-	} else {
-		out = query
+	status, err = job.Wait(ctx)
+	if err == nil {
+		err = status.Err()
 	}
-	return
+	if err != nil {
+		if ctx.Err() == nil {
+			err = scriptError(ctx, job, status, err)
+		}
+		return nil, nil, err
+	}
+
+	return job, status, nil
+}
+
+// cancelJob requests the cancellation of a job. It uses a context of its own, as the
+// context of the request the job was started for is already done at this point.
+func cancelJob(job *bigquery.Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), jobCancelTimeout)
+	defer cancel()
+
+	if err := job.Cancel(ctx); err != nil {
+		log.DefaultLogger.Warn("Failed to cancel BigQuery job", "job", job.ID(), "err", err)
+		return
+	}
+	log.DefaultLogger.Debug("Cancelled BigQuery job", "job", job.ID())
 }
 
 // Deprecated: Drivers should implement ExecerContext instead.
 func (c *Conn) Exec(query string, args []driver.Value) (res driver.Result, err error) {
-	return c.execContext(context.Background(), query, args)
+	return c.execContext(context.Background(), query, valuesToNamedValues(args))
 }
 
 func (c *Conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
-	_args, err := namedValueToValue(args)
+	return c.execContext(ctx, query, args)
+}
+
+func (c *Conn) execContext(ctx context.Context, query string, args []driver.NamedValue) (res driver.Result, err error) {
+	q, err := c.newQuery(ctx, query, args)
 	if err != nil {
 		return nil, err
 	}
-	return c.execContext(ctx, query, _args)
-}
 
-func (c *Conn) execContext(ctx context.Context, query string, args []driver.Value) (res driver.Result, err error) {
-	if query, err = prepareQuery(query, args); err != nil {
+	if err := c.preflight(ctx, q); err != nil {
 		return nil, err
 	}
 
-	q := c.client.Query(query)
-	// q.DefaultProjectID = c.cfg.Project // allows omitting project in table reference
-	// q.DefaultDatasetID = c.cfg.Dataset // allows omitting dataset in table reference
-
-	it, err := q.Read(ctx)
+	_, status, err := c.runJob(ctx, q)
 	if err != nil {
-		return nil, err
+		return nil, jobError(err, q)
 	}
 
-	for {
-		var row []bigquery.Value
-		err := it.Next(&row)
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-	}
+	return &result{rowsAffected: numDMLAffectedRows(status)}, nil
+}
 
-	res = &result{
-		rowsAffected: int64(it.TotalRows),
+// numDMLAffectedRows is the number of rows inserted, updated or deleted by a DML statement
+func numDMLAffectedRows(status *bigquery.JobStatus) int64 {
+	if status.Statistics == nil {
+		return 0
 	}
-
-	return
+	if statistics, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		return statistics.NumDMLAffectedRows
+	}
+	return 0
 }
 
 // NewConn returns a connection for this Config
 func NewConn(ctx context.Context, cfg types.ConnectionSettings, client *bq.Client) (c *Conn, err error) {
 	c = &Conn{
-		cfg: &cfg,
+		cfg:           &cfg,
+		storageDenied: &atomic.Bool{},
+	}
+
+	c.location, err = time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", cfg.TimeZone, err)
 	}
 
 	// c.client, err = bigquery.NewClient(ctx, cfg.Project, option.WithHTTPClient(client))
@@ -164,16 +272,22 @@ func NewConn(ctx context.Context, cfg types.ConnectionSettings, client *bq.Clien
 	return
 }
 
+// BigQueryConnector opens the connections of a sql.DB pool. It owns the clients the connections
+// share, they are closed with it when the pool is closed rather than with each connection.
 type BigQueryConnector struct {
 	Info       map[string]string
 	Client     *bigquery.Client
 	settings   types.ConnectionSettings
-	connection *Conn
 	bqClient   *bq.Client
+	readClient ReadClient
+	// storageDenied is shared by the connections, so that none of them retries a denied Storage Read API
+	storageDenied atomic.Bool
 }
 
-func NewConnector(settings types.ConnectionSettings, client *bq.Client) *BigQueryConnector {
-	return &BigQueryConnector{settings: settings, bqClient: client}
+// NewConnector returns a connector for these settings. readClient may be nil, large results are
+// then read through the rows like the others.
+func NewConnector(settings types.ConnectionSettings, client *bq.Client, readClient ReadClient) *BigQueryConnector {
+	return &BigQueryConnector{settings: settings, bqClient: client, readClient: readClient}
 }
 
 func (c *BigQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
@@ -182,11 +296,22 @@ func (c *BigQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.connection = conn
+	conn.readClient = c.readClient
+	conn.storageDenied = &c.storageDenied
 
 	return conn, nil
 }
 
+// Close closes the clients of the connector, it is called by sql.DB.Close
+func (c *BigQueryConnector) Close() error {
+	if closer, ok := c.readClient.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.DefaultLogger.Warn("Failed to close BigQuery Storage read client", "err", err)
+		}
+	}
+	return c.bqClient.Close()
+}
+
 func (c *BigQueryConnector) Driver() driver.Driver {
 	return &Driver{}
 }
@@ -209,47 +334,53 @@ func (c *Conn) Ping(ctx context.Context) (err error) {
 
 // Deprecated: Drivers should implement QueryerContext instead.
 func (c *Conn) Query(query string, args []driver.Value) (rows driver.Rows, err error) {
-	return c.queryContext(context.Background(), query, args)
+	return c.queryContext(context.Background(), query, valuesToNamedValues(args))
 }
 
 func (c *Conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
 	log.DefaultLogger.Info("QueryContext")
-	_args, err := namedValueToValue(args)
+	return c.queryContext(ctx, query, args)
+}
+
+func (c *Conn) queryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, err := c.newQuery(ctx, query, args)
 	if err != nil {
 		return nil, err
 	}
-	return c.queryContext(ctx, query, _args)
-}
 
-func (c *Conn) queryContext(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
-	q := c.client.Query(query)
-	q.Location = c.client.Location
-
-	rowsIterator, err := q.Read(ctx)
-	if err != nil {
+	if err := c.preflight(ctx, q); err != nil {
 		return nil, err
 	}
 
-	res := &rows{
-		rs:   resultSet{},
-		conn: c,
+	job, status, err := c.runJob(ctx, q)
+	if err != nil {
+		return nil, jobError(err, q)
 	}
-	for {
-		var row []bigquery.Value
-		err := rowsIterator.Next(&row)
-		if err == iterator.Done {
-			break
-		}
+
+	// The rows of a script are those of its last SELECT statement
+	if isScript(status) {
+		job, status, err = scriptResult(ctx, job, status, query)
 		if err != nil {
 			return nil, err
 		}
-		res.rs.data = append(res.rs.data, row)
 	}
 
-	for _, column := range rowsIterator.Schema {
-		res.columns = append(res.columns, column.Name)
-		res.fieldSchemas = append(res.fieldSchemas, column)
-		res.types = append(res.types, fmt.Sprintf("%v", column.Type))
+	rowsIterator, err := job.Read(ctx)
+	if err != nil {
+		return nil, jobError(err, q)
+	}
+
+	res, err := newRows(ctx, c, rowsIterator, query)
+	if err != nil {
+		return nil, jobError(err, q)
+	}
+
+	read, err := c.readStorage(ctx, job, res, rowsIterator.TotalRows)
+	if err != nil {
+		return nil, jobError(err, q)
+	}
+	if read {
+		log.DefaultLogger.Debug("Read query results with the Storage Read API", "job", job.ID(), "rows", rowsIterator.TotalRows)
 	}
 
 	return res, nil
@@ -261,12 +392,7 @@ func (c *Conn) Prepare(query string) (stmt driver.Stmt, err error) {
 	return
 }
 
-// Begin  is stubbed out and not used
-func (c *Conn) Begin() (driver.Tx, error) {
-	return newTx(c)
-}
-
-// Close closes the connection
+// Close closes the connection. The clients it used belong to the connector and are left open.
 func (c *Conn) Close() (err error) {
 	if c.closed {
 		return nil
@@ -275,5 +401,5 @@ func (c *Conn) Close() (err error) {
 		return driver.ErrBadConn
 	}
 	c.closed = true
-	return c.client.Close()
+	return nil
 }
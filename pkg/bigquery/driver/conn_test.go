@@ -0,0 +1,372 @@
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_queryParameters(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []driver.NamedValue
+		expected []bigquery.QueryParameter
+		Err      require.ErrorAssertionFunc
+	}{
+		{
+			name:     "no arguments",
+			args:     nil,
+			expected: nil,
+			Err:      require.NoError,
+		},
+		{
+			name: "positional arguments",
+			args: []driver.NamedValue{
+				{Ordinal: 1, Value: "it's"},
+				{Ordinal: 2, Value: int64(2)},
+				{Ordinal: 3, Value: nil},
+			},
+			expected: []bigquery.QueryParameter{
+				{Value: "it's"},
+				{Value: int64(2)},
+				{Value: bigquery.NullString{}},
+			},
+			Err: require.NoError,
+		},
+		{
+			name: "named arguments",
+			args: []driver.NamedValue{
+				{Name: "name", Ordinal: 1, Value: "grafana"},
+				{Name: "enabled", Ordinal: 2, Value: true},
+			},
+			expected: []bigquery.QueryParameter{
+				{Name: "name", Value: "grafana"},
+				{Name: "enabled", Value: true},
+			},
+			Err: require.NoError,
+		},
+		{
+			name: "mixed arguments",
+			args: []driver.NamedValue{
+				{Ordinal: 1, Value: "grafana"},
+				{Name: "enabled", Ordinal: 2, Value: true},
+			},
+			Err: require.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := queryParameters(tt.args)
+			tt.Err(t, err)
+			assert.Equal(t, tt.expected, params)
+		})
+	}
+}
+
+func Test_queryContext_sendsQueryParameters(t *testing.T) {
+	fake, client := newFakeBigQuery(t)
+	job := &fakeQueryJob{fields: []map[string]interface{}{{"name": "name", "type": "STRING"}}}
+	fake.handleQueryJob(t, job)
+
+	conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+	require.NoError(t, err)
+
+	query := "SELECT name FROM t WHERE name = ? AND note = '?'"
+	_, err = conn.QueryContext(context.Background(), query, []driver.NamedValue{{Ordinal: 1, Value: "o'brien"}})
+	require.NoError(t, err)
+
+	var config struct {
+		Query struct {
+			Query           string `json:"query"`
+			QueryParameters []struct {
+				Name           string                 `json:"name"`
+				ParameterType  struct{ Type string }  `json:"parameterType"`
+				ParameterValue struct{ Value string } `json:"parameterValue"`
+			} `json:"queryParameters"`
+		} `json:"query"`
+	}
+	decodeConfig(t, job, &config)
+
+	assert.Equal(t, query, config.Query.Query)
+	require.Len(t, config.Query.QueryParameters, 1)
+	assert.Equal(t, "STRING", config.Query.QueryParameters[0].ParameterType.Type)
+	assert.Equal(t, "o'brien", config.Query.QueryParameters[0].ParameterValue.Value)
+}
+
+func Test_queryContext_batchPriority(t *testing.T) {
+	newBatchConn := func(t *testing.T, job *fakeQueryJob) *Conn {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, job)
+
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{QueryPriority: "BATCH"}, client)
+		require.NoError(t, err)
+		return conn
+	}
+
+	t.Run("waits for the job and reads its results", func(t *testing.T) {
+		job := &fakeQueryJob{
+			fields: []map[string]interface{}{{"name": "id", "type": "INTEGER"}},
+			pages:  [][]map[string]interface{}{fakeRows([]interface{}{"1"})},
+		}
+		conn := newBatchConn(t, job)
+
+		res, err := conn.QueryContext(context.Background(), "SELECT 1", nil)
+		require.NoError(t, err)
+
+		var config struct {
+			Query struct{ Priority string } `json:"query"`
+		}
+		decodeConfig(t, job, &config)
+		assert.Equal(t, "BATCH", config.Query.Priority)
+
+		dest := make([]driver.Value, 1)
+		require.NoError(t, res.Next(dest))
+		assert.Equal(t, int64(1), dest[0])
+	})
+
+	t.Run("stops waiting when the request context is done", func(t *testing.T) {
+		conn := newBatchConn(t, &fakeQueryJob{running: true})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := conn.QueryContext(ctx, "SELECT 1", nil)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func Test_newQuery_defaultDataset(t *testing.T) {
+	_, client := newFakeBigQuery(t)
+
+	tests := []struct {
+		name               string
+		settings           types.ConnectionSettings
+		expectedProject    string
+		expectedDataset    string
+		expectedProperties []*bigquery.ConnectionProperty
+	}{
+		{
+			name:     "no dataset",
+			settings: types.ConnectionSettings{Project: "data"},
+		},
+		{
+			name:            "dataset of the query",
+			settings:        types.ConnectionSettings{Project: "data", JobProject: "data", Dataset: "events"},
+			expectedProject: "data",
+			expectedDataset: "events",
+		},
+		{
+			name:            "flat-rate project",
+			settings:        types.ConnectionSettings{Project: "data", JobProject: "slots", Dataset: "events"},
+			expectedProject: "data",
+			expectedDataset: "events",
+		},
+		{
+			name:               "flat-rate project without dataset",
+			settings:           types.ConnectionSettings{Project: "data", JobProject: "slots"},
+			expectedProperties: []*bigquery.ConnectionProperty{{Key: "dataset_project_id", Value: "data"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := NewConn(context.Background(), tt.settings, client)
+			require.NoError(t, err)
+
+			q, err := conn.newQuery(context.Background(), "SELECT * FROM logins", nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedProject, q.DefaultProjectID)
+			assert.Equal(t, tt.expectedDataset, q.DefaultDatasetID)
+			assert.Equal(t, tt.expectedProperties, q.ConnectionProperties)
+		})
+	}
+}
+
+func Test_execContext_defaultDataset(t *testing.T) {
+	fake, client := newFakeBigQuery(t)
+	job := &fakeQueryJob{}
+	fake.handleQueryJob(t, job)
+
+	conn, err := NewConn(context.Background(), types.ConnectionSettings{Project: "data", Dataset: "events"}, client)
+	require.NoError(t, err)
+
+	_, err = conn.ExecContext(context.Background(), "DELETE FROM logins WHERE true", nil)
+	require.NoError(t, err)
+
+	var config struct {
+		Query struct {
+			DefaultDataset struct {
+				ProjectID string `json:"projectId"`
+				DatasetID string `json:"datasetId"`
+			} `json:"defaultDataset"`
+		} `json:"query"`
+	}
+	decodeConfig(t, job, &config)
+	assert.Equal(t, "data", config.Query.DefaultDataset.ProjectID)
+	assert.Equal(t, "events", config.Query.DefaultDataset.DatasetID)
+}
+
+func Test_queryContext_maxBytesBilled(t *testing.T) {
+	fake, client := newFakeBigQuery(t)
+	job := &fakeQueryJob{errorReason: "bytesBilledLimitExceeded"}
+	fake.handleQueryJob(t, job)
+
+	conn, err := NewConn(context.Background(), types.ConnectionSettings{MaxBytesBilled: 1048576}, client)
+	require.NoError(t, err)
+
+	_, err = conn.QueryContext(context.Background(), "SELECT * FROM huge", nil)
+
+	var config struct {
+		Query struct {
+			MaximumBytesBilled string `json:"maximumBytesBilled"`
+		} `json:"query"`
+	}
+	decodeConfig(t, job, &config)
+	assert.Equal(t, "1048576", config.Query.MaximumBytesBilled)
+
+	var limitErr *BytesBilledLimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, int64(1048576), limitErr.Limit)
+	assert.Contains(t, err.Error(), "maximum bytes billed limit of 1.0 MiB")
+}
+
+func Test_queryContext_preflight(t *testing.T) {
+	newPreflightFake := func(t *testing.T, estimatedBytes string) (*fakeBigQuery, *Conn) {
+		fake, client := newFakeBigQuery(t)
+		fake.handle("POST /projects/test-project/jobs", func(w http.ResponseWriter, r *http.Request) {
+			var job struct {
+				JobReference  map[string]interface{} `json:"jobReference"`
+				Configuration struct {
+					DryRun bool `json:"dryRun"`
+				} `json:"configuration"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&job))
+			if !job.Configuration.DryRun {
+				http.Error(w, "not a dry run", http.StatusTeapot)
+				return
+			}
+			writeJSON(w, map[string]interface{}{
+				"jobReference": job.JobReference,
+				"status":       map[string]interface{}{"state": "DONE"},
+				"statistics":   map[string]interface{}{"totalBytesProcessed": estimatedBytes, "query": map[string]interface{}{}},
+			})
+		})
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{PreflightBytesLimit: 1 << 40}, client)
+		require.NoError(t, err)
+		return fake, conn
+	}
+
+	t.Run("runs queries below the limit", func(t *testing.T) {
+		fake, conn := newPreflightFake(t, "1024")
+
+		_, err := conn.QueryContext(context.Background(), "SELECT id FROM t", nil)
+		// the dry run passed, the real job is created next
+		require.ErrorContains(t, err, "not a dry run")
+		assert.Equal(t, 2, fake.count("POST /projects/test-project/jobs"))
+	})
+
+	t.Run("refuses queries above the limit", func(t *testing.T) {
+		fake, conn := newPreflightFake(t, "2199023255552")
+
+		_, err := conn.QueryContext(context.Background(), "SELECT id FROM t", nil)
+		var preflightErr *PreflightLimitError
+		require.ErrorAs(t, err, &preflightErr)
+		assert.Equal(t, int64(2199023255552), preflightErr.EstimatedBytes)
+		assert.Contains(t, err.Error(), "query would process 2.0 TiB (estimated on-demand cost $12.50)")
+		assert.Equal(t, 1, fake.count("POST /projects/test-project/jobs"))
+	})
+}
+
+func Test_cancelsJobWhenContextIsDone(t *testing.T) {
+	tests := map[string]func(conn *Conn, ctx context.Context) error{
+		"query": func(conn *Conn, ctx context.Context) error {
+			_, err := conn.QueryContext(ctx, "SELECT * FROM slow", nil)
+			return err
+		},
+		"exec": func(conn *Conn, ctx context.Context) error {
+			_, err := conn.ExecContext(ctx, "DELETE FROM slow WHERE true", nil)
+			return err
+		},
+	}
+	for name, run := range tests {
+		t.Run(name, func(t *testing.T) {
+			fake, client := newFakeBigQuery(t)
+			fake.handleQueryJob(t, &fakeQueryJob{running: true})
+
+			conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			require.ErrorIs(t, run(conn, ctx), context.Canceled)
+			assert.Eventually(t, func() bool {
+				return fake.count("POST /projects/test-project/jobs/*/cancel") == 1
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func decodeConfig(t *testing.T, job *fakeQueryJob, v interface{}) {
+	t.Helper()
+	b, err := json.Marshal(job.config())
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, v))
+}
+
+func Test_execContext_rowsAffected(t *testing.T) {
+	fake, client := newFakeBigQuery(t)
+	fake.handleQueryJob(t, &fakeQueryJob{
+		statistics: map[string]interface{}{
+			"query": map[string]interface{}{"statementType": "UPDATE", "numDmlAffectedRows": "42"},
+		},
+	})
+
+	conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+	require.NoError(t, err)
+
+	res, err := conn.ExecContext(context.Background(), "UPDATE t SET done = true WHERE id < 43", nil)
+	require.NoError(t, err)
+
+	rowsAffected, err := res.RowsAffected()
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), rowsAffected)
+	// waiting for the job only, results of DML statements are not read
+	assert.Equal(t, 1, fake.count("GET /projects/test-project/queries/*"))
+}
+
+func Test_NewConn_invalidTimeZone(t *testing.T) {
+	_, err := NewConn(context.Background(), types.ConnectionSettings{TimeZone: "Mars/Olympus_Mons"}, nil)
+	assert.ErrorContains(t, err, `invalid time zone "Mars/Olympus_Mons"`)
+}
+
+func Test_OpenDB_connectionLifetime(t *testing.T) {
+	fake, client := newFakeBigQuery(t)
+	fake.handleQueryJob(t, &fakeQueryJob{
+		fields: []map[string]interface{}{{"name": "id", "type": "INTEGER"}},
+		pages:  [][]map[string]interface{}{fakeRows([]interface{}{"1"})},
+	})
+
+	readClient := &fakeReadClient{}
+	db := OpenDB(types.ConnectionSettings{}, client, readClient)
+	db.SetMaxOpenConns(1)
+
+	for i := 0; i < 2; i++ {
+		rows, err := db.QueryContext(context.Background(), "SELECT id FROM t")
+		require.NoError(t, err)
+		require.True(t, rows.Next())
+		require.NoError(t, rows.Close())
+		assert.False(t, readClient.closed, "closing rows must not close the clients of the pool")
+	}
+	assert.Equal(t, 1, db.Stats().OpenConnections, "the connection must be reused once the rows are closed")
+
+	require.NoError(t, db.Close())
+	assert.True(t, readClient.closed)
+}
@@ -1,11 +1,9 @@
 package driver
 
 import (
-	"context"
 	"database/sql"
 	"database/sql/driver"
-	"fmt"
-	"sync"
+	"errors"
 
 	bq "cloud.google.com/go/bigquery"
 	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
@@ -15,53 +13,18 @@ const (
 	ConnectionStringEnvKey = "BIGQUERY_CONNECTION_STRING"
 )
 
-var (
-	openFromSessionMutex sync.Mutex
-	openFromSessionCount int
-)
+// ErrConnectorRequired is returned when a connection is opened by name, connections are opened by a BigQueryConnector
+var ErrConnectorRequired = errors.New("BigQuery connections are opened through a connector, use driver.OpenDB")
 
-type Driver struct {
-	connector *BigQueryConnector
-	bqClient  *bq.Client
-	settings  types.ConnectionSettings
-}
+type Driver struct{}
 
+// Open is not supported, the settings and clients of connections are held by the connector
 func (d *Driver) Open(_ string) (c driver.Conn, err error) {
-	connector, err := d.OpenConnector()
-	if err != nil {
-		return
-	}
-	connection, err := connector.Connect(context.Background())
-	if err != nil {
-		return nil, err
-	}
-
-	d.connector = connector
-
-	return connection, nil
-}
-
-func (d *Driver) OpenConnector() (c *BigQueryConnector, err error) {
-	return NewConnector(d.settings, d.bqClient), nil
-}
-
-func (d *Driver) Closed() bool {
-	return d.connector == nil || d.connector.connection.closed
+	return nil, ErrConnectorRequired
 }
 
-// Open registers a new driver with a unique name
-func Open(settings types.ConnectionSettings, bqClient *bq.Client) (*Driver, *sql.DB, error) {
-	openFromSessionMutex.Lock()
-	openFromSessionCount++
-	name := fmt.Sprintf("%s-%d", "bigquery", openFromSessionCount)
-	openFromSessionMutex.Unlock()
-
-	d := &Driver{
-		bqClient: bqClient,
-		settings: settings,
-	}
-	sql.Register(name, d)
-	db, err := sql.Open(name, "")
-
-	return d, db, err
+// OpenDB returns a pool of connections sharing the given clients, which are closed when the pool is.
+// readClient reads large results with the Storage Read API, it may be nil.
+func OpenDB(settings types.ConnectionSettings, bqClient *bq.Client, readClient ReadClient) *sql.DB {
+	return sql.OpenDB(NewConnector(settings, bqClient, readClient))
 }
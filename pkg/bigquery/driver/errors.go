@@ -0,0 +1,112 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	bytesBilledLimitExceededReason = "bytesBilledLimitExceeded"
+	// onDemandPricePerTiB is the BigQuery on-demand analysis list price, used to estimate query costs
+	onDemandPricePerTiB = 6.25
+)
+
+// BytesBilledLimitError is returned when BigQuery refuses to run a job because it would bill
+// more bytes than the configured maximum bytes billed.
+type BytesBilledLimitError struct {
+	Limit int64
+	Err   error
+}
+
+func (e *BytesBilledLimitError) Error() string {
+	return fmt.Sprintf("query exceeds the maximum bytes billed limit of %s (%d bytes), narrow down the scanned partitions or columns, or raise the limit: %s", formatBytes(e.Limit), e.Limit, e.Err)
+}
+
+func (e *BytesBilledLimitError) Unwrap() error {
+	return e.Err
+}
+
+// PreflightLimitError is returned when the dry run of a query estimates that it would process
+// more bytes than the configured preflight limit. The query is not run in that case.
+type PreflightLimitError struct {
+	EstimatedBytes int64
+	Limit          int64
+}
+
+// EstimatedCost is the on-demand price of the query in USD
+func (e *PreflightLimitError) EstimatedCost() float64 {
+	return float64(e.EstimatedBytes) / (1 << 40) * onDemandPricePerTiB
+}
+
+func (e *PreflightLimitError) Error() string {
+	return fmt.Sprintf("query would process %s (estimated on-demand cost $%.2f), which is above the limit of %s; narrow down the scanned partitions or columns before running it", formatBytes(e.EstimatedBytes), e.EstimatedCost(), formatBytes(e.Limit))
+}
+
+// ScriptError is returned when a statement of a multi-statement script fails. Statement is the
+// position of the statement among those the script ran, from 1. Line and Column locate it in the
+// script, they are 0 when BigQuery didn't report them.
+type ScriptError struct {
+	Statement int
+	Line      int64
+	Column    int64
+	Err       error
+}
+
+func (e *ScriptError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("statement %d of the script failed at line %d, column %d: %s", e.Statement, e.Line, e.Column, e.Err)
+	}
+	return fmt.Sprintf("statement %d of the script failed: %s", e.Statement, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// jobError converts errors returned by BigQuery for a query job into the typed errors of this driver
+func jobError(err error, q *bigquery.Query) error {
+	if err == nil {
+		return nil
+	}
+
+	if hasReason(err, bytesBilledLimitExceededReason) {
+		return &BytesBilledLimitError{Limit: q.MaxBytesBilled, Err: err}
+	}
+
+	return err
+}
+
+// hasReason reports whether a BigQuery API or job error carries the given error reason
+func hasReason(err error, reason string) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		for _, item := range apiErr.Errors {
+			if item.Reason == reason {
+				return true
+			}
+		}
+	}
+
+	var jobErr *bigquery.Error
+	if errors.As(err, &jobErr) {
+		return jobErr.Reason == reason
+	}
+
+	return false
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
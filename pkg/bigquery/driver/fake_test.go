@@ -0,0 +1,221 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+// fakeBigQuery is a minimal in-process stand-in for the BigQuery REST API. Routes are
+// registered as "METHOD pattern" where pattern follows path.Match, e.g. "GET /projects/*/queries/*".
+type fakeBigQuery struct {
+	mu     sync.Mutex
+	routes []fakeRoute
+	calls  map[string]int
+}
+
+type fakeRoute struct {
+	route   string
+	handler http.HandlerFunc
+}
+
+func newFakeBigQuery(t *testing.T) (*fakeBigQuery, *bigquery.Client) {
+	f := &fakeBigQuery{calls: map[string]int{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	client, err := bigquery.NewClient(context.Background(), "test-project", option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+	client.Location = "US"
+
+	return f, client
+}
+
+func (f *fakeBigQuery) handle(route string, handler http.HandlerFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes = append(f.routes, fakeRoute{route: route, handler: handler})
+}
+
+func (f *fakeBigQuery) count(route string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[route]
+}
+
+func (f *fakeBigQuery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	var handler http.HandlerFunc
+	for _, rt := range f.routes {
+		method, pattern, _ := strings.Cut(rt.route, " ")
+		if ok, _ := path.Match(pattern, r.URL.Path); ok && method == r.Method {
+			f.calls[rt.route]++
+			handler = rt.handler
+			break
+		}
+	}
+	f.mu.Unlock()
+
+	if handler == nil {
+		http.Error(w, "no fake route for "+r.Method+" "+r.URL.Path, http.StatusNotImplemented)
+		return
+	}
+	handler(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// fakeRows builds the REST representation of result rows from string cell values.
+func fakeRows(values ...[]interface{}) []map[string]interface{} {
+	res := make([]map[string]interface{}, len(values))
+	for i, row := range values {
+		cells := make([]map[string]interface{}, len(row))
+		for j, v := range row {
+			cells[j] = map[string]interface{}{"v": v}
+		}
+		res[i] = map[string]interface{}{"f": cells}
+	}
+	return res
+}
+
+// fakeQueryJob serves a query job created through jobs.insert. Its result rows are served in
+// pages, the page following page n is requested with the page token "page-<n+1>".
+type fakeQueryJob struct {
+	fields []map[string]interface{}
+	pages  [][]map[string]interface{}
+	// running keeps the job from ever completing
+	running bool
+	// errorReason fails jobs whose query contains failOn, or every job if failOn is empty
+	errorReason string
+	failOn      string
+	statistics  map[string]interface{}
+	// destinationTable is the table the results are written to, as BigQuery reports it once the job is inserted
+	destinationTable map[string]interface{}
+
+	mu       sync.Mutex
+	inserted map[string]interface{}
+	configs  []map[string]interface{}
+	failing  bool
+}
+
+// config returns the configuration of the last inserted job
+func (j *fakeQueryJob) config() map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	config, _ := j.inserted["configuration"].(map[string]interface{})
+	return config
+}
+
+// queries returns the query configurations of all inserted jobs
+func (j *fakeQueryJob) queries() []map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	queries := make([]map[string]interface{}, len(j.configs))
+	for i, config := range j.configs {
+		queries[i], _ = config["query"].(map[string]interface{})
+	}
+	return queries
+}
+
+func (f *fakeBigQuery) handleQueryJob(t *testing.T, job *fakeQueryJob) {
+	fail := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{
+			"code":    http.StatusBadRequest,
+			"message": "job failed: " + job.errorReason,
+			"errors":  []map[string]interface{}{{"reason": job.errorReason, "message": "job failed"}},
+		}})
+	}
+	jobResource := func() map[string]interface{} {
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		status := map[string]interface{}{"state": "DONE"}
+		if job.running {
+			status["state"] = "RUNNING"
+		}
+		if job.failing {
+			status["errorResult"] = map[string]interface{}{"reason": job.errorReason, "message": "job failed"}
+		}
+		return map[string]interface{}{
+			"jobReference":  job.inserted["jobReference"],
+			"configuration": job.inserted["configuration"],
+			"status":        status,
+			"statistics":    job.statistics,
+		}
+	}
+
+	f.handle("POST /projects/test-project/jobs", func(w http.ResponseWriter, r *http.Request) {
+		job.mu.Lock()
+		job.inserted = nil
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&job.inserted))
+		config, _ := job.inserted["configuration"].(map[string]interface{})
+		job.configs = append(job.configs, config)
+		query, _ := config["query"].(map[string]interface{})
+		if job.destinationTable != nil {
+			query["destinationTable"] = job.destinationTable
+		}
+		job.failing = job.errorReason != "" && strings.Contains(fmt.Sprint(query["query"]), job.failOn)
+		job.mu.Unlock()
+		res := jobResource()
+		res["status"] = map[string]interface{}{"state": "PENDING"}
+		writeJSON(w, res)
+	})
+	f.handle("GET /projects/test-project/jobs/*", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, jobResource())
+	})
+	f.handle("POST /projects/test-project/jobs/*/cancel", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"job": jobResource()})
+	})
+	f.handle("GET /projects/test-project/queries/*", func(w http.ResponseWriter, r *http.Request) {
+		job.mu.Lock()
+		failing := job.failing
+		job.mu.Unlock()
+		if failing {
+			fail(w)
+			return
+		}
+
+		totalRows := 0
+		for _, page := range job.pages {
+			totalRows += len(page)
+		}
+		res := map[string]interface{}{
+			"jobComplete": !job.running,
+			"schema":      map[string]interface{}{"fields": job.fields},
+			"totalRows":   strconv.Itoa(totalRows),
+		}
+
+		// waiting for the job to complete doesn't read any rows
+		if r.URL.Query().Get("maxResults") == "0" || job.running {
+			writeJSON(w, res)
+			return
+		}
+
+		page := 0
+		if token := r.URL.Query().Get("pageToken"); token != "" {
+			page, _ = strconv.Atoi(strings.TrimPrefix(token, "page-"))
+		}
+		if page < len(job.pages) {
+			res["rows"] = job.pages[page]
+		}
+		if page+1 < len(job.pages) {
+			res["pageToken"] = fmt.Sprintf("page-%d", page+1)
+		}
+		writeJSON(w, res)
+	})
+}
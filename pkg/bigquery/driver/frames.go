@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Frames collects the frames of the results read with the Storage Read API. Those results are
+// converted to frames straight from their Arrow record batches rather than through the rows, the
+// frames replace the empty ones built from the rows. Frames are kept per executed query string.
+type Frames struct {
+	mu      sync.Mutex
+	byQuery map[string]*data.Frame
+}
+
+type framesKey struct{}
+
+// WithFrames returns a context collecting the frames read with the Storage Read API for the queries run with it
+func WithFrames(ctx context.Context) (context.Context, *Frames) {
+	frames := &Frames{byQuery: map[string]*data.Frame{}}
+	return context.WithValue(ctx, framesKey{}, frames), frames
+}
+
+func framesFromContext(ctx context.Context) *Frames {
+	frames, _ := ctx.Value(framesKey{}).(*Frames)
+	return frames
+}
+
+// add records the frame read for a query
+func (f *Frames) add(query string, frame *data.Frame) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.byQuery[query] = frame
+}
+
+// For returns the frame read for a query, or nil if its result was read through the rows
+func (f *Frames) For(query string) *data.Frame {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.byQuery[query]
+}
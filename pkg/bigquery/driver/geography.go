@@ -0,0 +1,244 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// geometry is a GeoJSON geometry, see https://datatracker.ietf.org/doc/html/rfc7946#section-3.1
+type geometry map[string]interface{}
+
+// parsedGeography is a GEOGRAPHY value parsed from WKT, or the error parsing it
+type parsedGeography struct {
+	geometry geometry
+	err      error
+}
+
+func parseGeography(wkt string) parsedGeography {
+	g, err := parseWKT(wkt)
+	return parsedGeography{geometry: g, err: err}
+}
+
+// geoJSON converts the geography, which BigQuery returns as WKT, to GeoJSON
+func (g parsedGeography) geoJSON() (string, error) {
+	if g.err != nil {
+		return "", g.err
+	}
+
+	res, err := json.Marshal(g.geometry)
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
+
+// point returns the longitude and latitude of a POINT geography. Other geographies aren't points.
+func (g parsedGeography) point() (longitude float64, latitude float64, ok bool) {
+	if g.err != nil || g.geometry["type"] != "Point" {
+		return 0, 0, false
+	}
+
+	coordinates, _ := g.geometry["coordinates"].([]float64)
+	if len(coordinates) != 2 {
+		return 0, 0, false
+	}
+	return coordinates[0], coordinates[1], true
+}
+
+// parseWKT parses a WKT geometry, as BigQuery formats them: two-dimensional, longitude first.
+// See https://cloud.google.com/bigquery/docs/reference/standard-sql/geography_functions#st_astext
+func parseWKT(wkt string) (geometry, error) {
+	p := &wktParser{tokens: tokenizeWKT(wkt)}
+	g, err := p.geometry()
+	if err != nil {
+		return nil, fmt.Errorf("invalid WKT geometry %q: %w", wkt, err)
+	}
+	if token := p.next(); token != "" {
+		return nil, fmt.Errorf("invalid WKT geometry %q: unexpected %q after the geometry", wkt, token)
+	}
+	return g, nil
+}
+
+// tokenizeWKT splits WKT into words, numbers and punctuation
+func tokenizeWKT(wkt string) []string {
+	var tokens []string
+	start := -1
+	for i, r := range wkt {
+		if unicode.IsSpace(r) || r == '(' || r == ')' || r == ',' {
+			if start >= 0 {
+				tokens = append(tokens, wkt[start:i])
+				start = -1
+			}
+			if !unicode.IsSpace(r) {
+				tokens = append(tokens, string(r))
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, wkt[start:])
+	}
+	return tokens
+}
+
+type wktParser struct {
+	tokens []string
+}
+
+func (p *wktParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *wktParser) next() string {
+	token := p.peek()
+	if token != "" {
+		p.tokens = p.tokens[1:]
+	}
+	return token
+}
+
+func (p *wktParser) expect(token string) error {
+	if next := p.next(); next != token {
+		return fmt.Errorf("expected %q, got %q", token, next)
+	}
+	return nil
+}
+
+// empty consumes the EMPTY keyword of empty geometries
+func (p *wktParser) empty() bool {
+	if strings.EqualFold(p.peek(), "EMPTY") {
+		p.next()
+		return true
+	}
+	return false
+}
+
+// list parses a parenthesized, comma separated list
+func (p *wktParser) list(element func() (interface{}, error)) ([]interface{}, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var res []interface{}
+	for {
+		v, err := element()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (p *wktParser) position() (interface{}, error) {
+	longitude, err := strconv.ParseFloat(p.next(), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid longitude: %w", err)
+	}
+	latitude, err := strconv.ParseFloat(p.next(), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid latitude: %w", err)
+	}
+	return []float64{longitude, latitude}, nil
+}
+
+func (p *wktParser) positions() (interface{}, error) {
+	return p.list(p.position)
+}
+
+func (p *wktParser) rings() (interface{}, error) {
+	return p.list(p.positions)
+}
+
+// multiPointPosition parses the positions of a MULTIPOINT, which may or may not be parenthesized
+func (p *wktParser) multiPointPosition() (interface{}, error) {
+	if p.peek() != "(" {
+		return p.position()
+	}
+	p.next()
+	position, err := p.position()
+	if err != nil {
+		return nil, err
+	}
+	return position, p.expect(")")
+}
+
+func (p *wktParser) geometry() (geometry, error) {
+	kind := strings.ToUpper(p.next())
+
+	var (
+		geoJSONType string
+		coordinates func() (interface{}, error)
+	)
+	switch kind {
+	case "POINT":
+		geoJSONType = "Point"
+		coordinates = func() (interface{}, error) {
+			if err := p.expect("("); err != nil {
+				return nil, err
+			}
+			position, err := p.position()
+			if err != nil {
+				return nil, err
+			}
+			return position, p.expect(")")
+		}
+	case "LINESTRING":
+		geoJSONType, coordinates = "LineString", p.positions
+	case "POLYGON":
+		geoJSONType, coordinates = "Polygon", p.rings
+	case "MULTIPOINT":
+		geoJSONType = "MultiPoint"
+		coordinates = func() (interface{}, error) {
+			return p.list(p.multiPointPosition)
+		}
+	case "MULTILINESTRING":
+		geoJSONType, coordinates = "MultiLineString", p.rings
+	case "MULTIPOLYGON":
+		geoJSONType = "MultiPolygon"
+		coordinates = func() (interface{}, error) {
+			return p.list(p.rings)
+		}
+	case "GEOMETRYCOLLECTION":
+		geometries := []interface{}{}
+		if !p.empty() {
+			var err error
+			geometries, err = p.list(func() (interface{}, error) {
+				return p.geometry()
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return geometry{"type": "GeometryCollection", "geometries": geometries}, nil
+	default:
+		return nil, fmt.Errorf("unsupported geometry type %q", kind)
+	}
+
+	if p.empty() {
+		return geometry{"type": geoJSONType, "coordinates": []interface{}{}}, nil
+	}
+	res, err := coordinates()
+	if err != nil {
+		return nil, err
+	}
+	return geometry{"type": geoJSONType, "coordinates": res}, nil
+}
@@ -0,0 +1,63 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parsedGeography_geoJSON(t *testing.T) {
+	tests := []struct {
+		wkt      string
+		expected string
+	}{
+		{wkt: "POINT(1 2)", expected: `{"coordinates":[1,2],"type":"Point"}`},
+		{wkt: "POINT(-122.35 47.62)", expected: `{"coordinates":[-122.35,47.62],"type":"Point"}`},
+		{wkt: "POINT EMPTY", expected: `{"coordinates":[],"type":"Point"}`},
+		{wkt: "LINESTRING(1 2, 3 4)", expected: `{"coordinates":[[1,2],[3,4]],"type":"LineString"}`},
+		{wkt: "POLYGON((0 0, 1 0, 1 1, 0 0), (0.1 0.1, 0.2 0.1, 0.2 0.2, 0.1 0.1))", expected: `{"coordinates":[[[0,0],[1,0],[1,1],[0,0]],[[0.1,0.1],[0.2,0.1],[0.2,0.2],[0.1,0.1]]],"type":"Polygon"}`},
+		{wkt: "MULTIPOINT(1 2, (3 4))", expected: `{"coordinates":[[1,2],[3,4]],"type":"MultiPoint"}`},
+		{wkt: "MULTILINESTRING((1 2, 3 4), (5 6, 7 8))", expected: `{"coordinates":[[[1,2],[3,4]],[[5,6],[7,8]]],"type":"MultiLineString"}`},
+		{wkt: "MULTIPOLYGON(((0 0, 1 0, 1 1, 0 0)), ((2 2, 3 2, 3 3, 2 2)))", expected: `{"coordinates":[[[[0,0],[1,0],[1,1],[0,0]]],[[[2,2],[3,2],[3,3],[2,2]]]],"type":"MultiPolygon"}`},
+		{wkt: "GEOMETRYCOLLECTION(POINT(1 2), LINESTRING(1 2, 3 4))", expected: `{"geometries":[{"coordinates":[1,2],"type":"Point"},{"coordinates":[[1,2],[3,4]],"type":"LineString"}],"type":"GeometryCollection"}`},
+		{wkt: "GEOMETRYCOLLECTION EMPTY", expected: `{"geometries":[],"type":"GeometryCollection"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wkt, func(t *testing.T) {
+			res, err := parseGeography(tt.wkt).geoJSON()
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.expected, res)
+		})
+	}
+}
+
+func Test_parsedGeography_geoJSON_invalid(t *testing.T) {
+	for _, wkt := range []string{
+		"",
+		"POINT(1)",
+		"POINT(1 2",
+		"POINT(a b)",
+		"POINT(1 2) POINT(3 4)",
+		"LINESTRING(1 2,)",
+		"CIRCLE(1 2, 3)",
+	} {
+		t.Run(wkt, func(t *testing.T) {
+			_, err := parseGeography(wkt).geoJSON()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_parsedGeography_point(t *testing.T) {
+	longitude, latitude, ok := parseGeography("POINT(-122.35 47.62)").point()
+	assert.True(t, ok)
+	assert.Equal(t, -122.35, longitude)
+	assert.Equal(t, 47.62, latitude)
+
+	for _, wkt := range []string{"POINT EMPTY", "LINESTRING(1 2, 3 4)", "POINT(1"} {
+		_, _, ok = parseGeography(wkt).point()
+		assert.False(t, ok, wkt)
+	}
+}
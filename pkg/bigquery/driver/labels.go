@@ -0,0 +1,75 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// BigQuery allows at most 64 labels on a job, with keys and values of at most 63 characters.
+// See https://cloud.google.com/bigquery/docs/labels-intro#requirements
+const (
+	maxJobLabels      = 64
+	maxJobLabelLength = 63
+)
+
+type jobLabelsKey struct{}
+
+// WithJobLabels returns a context carrying labels that are attached to the jobs created for queries run with it
+func WithJobLabels(ctx context.Context, labels map[string]string) context.Context {
+	return context.WithValue(ctx, jobLabelsKey{}, labels)
+}
+
+func jobLabelsFromContext(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(jobLabelsKey{}).(map[string]string)
+	return labels
+}
+
+// jobLabels merges the static labels of the connection with the labels of the request,
+// sanitized to the BigQuery label requirements. Request labels take precedence.
+func jobLabels(ctx context.Context, static map[string]string) map[string]string {
+	labels := map[string]string{}
+	for _, source := range []map[string]string{static, jobLabelsFromContext(ctx)} {
+		for key, value := range source {
+			key = sanitizeLabelKey(key)
+			if key == "" {
+				continue
+			}
+			if _, exists := labels[key]; !exists && len(labels) == maxJobLabels {
+				continue
+			}
+			labels[key] = sanitizeLabel(value)
+		}
+	}
+
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// sanitizeLabelKey sanitizes a label key, which additionally has to start with a letter
+func sanitizeLabelKey(key string) string {
+	key = sanitizeLabel(key)
+	if key != "" && !unicode.IsLower([]rune(key)[0]) {
+		key = sanitizeLabel("l_" + key)
+	}
+	return key
+}
+
+// sanitizeLabel lowercases the given string and replaces every character that is not allowed
+// in BigQuery labels with an underscore
+func sanitizeLabel(s string) string {
+	s = strings.Map(func(r rune) rune {
+		r = unicode.ToLower(r)
+		if unicode.IsLower(r) || unicode.IsDigit(r) || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+
+	if runes := []rune(s); len(runes) > maxJobLabelLength {
+		s = string(runes[:maxJobLabelLength])
+	}
+	return s
+}
@@ -0,0 +1,50 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_jobLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		static   map[string]string
+		request  map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "no labels",
+			expected: nil,
+		},
+		{
+			name:     "static labels",
+			static:   map[string]string{"team": "observability"},
+			expected: map[string]string{"team": "observability"},
+		},
+		{
+			name:     "request labels take precedence",
+			static:   map[string]string{"team": "observability", "grafana_user": "static"},
+			request:  map[string]string{"grafana_user": "admin"},
+			expected: map[string]string{"team": "observability", "grafana_user": "admin"},
+		},
+		{
+			name:     "sanitizes keys and values",
+			request:  map[string]string{"Cost Center": "R&D", "1st": "Jane.Doe@Example.com"},
+			expected: map[string]string{"cost_center": "r_d", "l_1st": "jane_doe_example_com"},
+		},
+		{
+			name:     "truncates long values",
+			request:  map[string]string{"dashboard": strings.Repeat("a", 70)},
+			expected: map[string]string{"dashboard": strings.Repeat("a", 63)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := WithJobLabels(context.Background(), tt.request)
+			assert.Equal(t, tt.expected, jobLabels(ctx, tt.static))
+		})
+	}
+}
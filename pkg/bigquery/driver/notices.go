@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Notices collects the notices raised while reading the results of queries, so that they can be
+// attached to the frames of those queries. Notices are kept per executed query string.
+type Notices struct {
+	mu      sync.Mutex
+	byQuery map[string][]data.Notice
+}
+
+type noticesKey struct{}
+
+// WithNotices returns a context collecting the notices of the queries run with it
+func WithNotices(ctx context.Context) (context.Context, *Notices) {
+	notices := &Notices{byQuery: map[string][]data.Notice{}}
+	return context.WithValue(ctx, noticesKey{}, notices), notices
+}
+
+func noticesFromContext(ctx context.Context) *Notices {
+	notices, _ := ctx.Value(noticesKey{}).(*Notices)
+	return notices
+}
+
+// add records a notice for a query, once. It is a no-op on nil Notices.
+func (n *Notices) add(query string, notice data.Notice) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, existing := range n.byQuery[query] {
+		if existing == notice {
+			return
+		}
+	}
+	n.byQuery[query] = append(n.byQuery[query], notice)
+}
+
+// For returns the notices recorded for a query
+func (n *Notices) For(query string) []data.Notice {
+	if n == nil {
+		return nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.byQuery[query]
+}
@@ -1,16 +1,20 @@
 package driver
 
+import "errors"
+
+// ErrLastInsertIdUnsupported is returned by LastInsertId, as BigQuery has no auto-generated row ids
+var ErrLastInsertIdUnsupported = errors.New("LastInsertId is not supported by BigQuery, which has no auto-generated row ids")
+
 type result struct {
-	lastInsertID int64
 	rowsAffected int64
 }
 
-// LastInsertId is just passing through a zero value
+// LastInsertId is not supported by BigQuery
 func (r *result) LastInsertId() (int64, error) {
-	return r.lastInsertID, nil
+	return 0, ErrLastInsertIdUnsupported
 }
 
-//RowsAffected is just passing through a zero value
+// RowsAffected is the number of rows inserted, updated or deleted by a DML statement
 func (r *result) RowsAffected() (int64, error) {
 	return r.rowsAffected, nil
 }
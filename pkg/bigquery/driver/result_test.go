@@ -1,35 +1,36 @@
 package driver
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func Test_result_LastInsertId(t *testing.T) {
 	type fields struct {
 		rowsAffected int64
-		lastInsertID int64
 	}
 	tests := []struct {
 		name    string
 		fields  fields
 		want    int64
-		wantErr bool
+		wantErr error
 	}{
 		{
-			name: "OK",
+			name: "unsupported",
 			fields: fields{
-				lastInsertID: 3,
+				rowsAffected: 3,
 			},
-			want:    3,
-			wantErr: false,
+			want:    0,
+			wantErr: ErrLastInsertIdUnsupported,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &result{
-				lastInsertID: tt.fields.lastInsertID,
 				rowsAffected: tt.fields.rowsAffected,
 			}
 			got, err := r.LastInsertId()
-			if (err != nil) != tt.wantErr {
+			if !errors.Is(err, tt.wantErr) {
 				t.Errorf("LastInsertId() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
@@ -43,7 +44,6 @@ func Test_result_LastInsertId(t *testing.T) {
 func Test_result_RowsAffected(t *testing.T) {
 	type fields struct {
 		rowsAffected int64
-		lastInsertID int64
 	}
 	tests := []struct {
 		name    string
@@ -63,7 +63,6 @@ func Test_result_RowsAffected(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &result{
-				lastInsertID: tt.fields.lastInsertID,
 				rowsAffected: tt.fields.rowsAffected,
 			}
 			got, err := r.RowsAffected()
@@ -1,46 +1,246 @@
 package driver
 
 import (
+	"context"
 	"database/sql/driver"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"google.golang.org/api/iterator"
 )
 
-type resultSet struct {
-	data [][]bigquery.Value
-	num  int
-}
-
 type rows struct {
 	columns      []string
 	fieldSchemas []*bigquery.FieldSchema
 	types        []string
-	rs           resultSet
-	conn         *Conn
+	it           *bigquery.RowIterator
+	// peeked holds a row that was read ahead to resolve the schema
+	peeked    []bigquery.Value
+	conn      *Conn
+	converter ValueConverter
+	// query and notices are where notices about the values of the result are reported
+	query   string
+	notices *Notices
+	// unnestIndex is the array column expanded into a row per element, or -1
+	unnestIndex int
+	// unnestedColumns tells whether the array column was expanded into a column per index
+	unnestedColumns bool
+	// expanded holds rows produced by unnesting that are yet to be returned
+	expanded [][]bigquery.Value
+	// derived are the columns computed from the values of another column
+	derived []derivedColumns
+}
+
+// derivedColumns are columns computed from the value of another column, added after it
+type derivedColumns struct {
+	// index is the column the values are computed from
+	index int
+	// values computes the values of the added columns. It returns the value of the column as well, which
+	// it may replace with an intermediate result its conversion reuses.
+	values func(v bigquery.Value) (bigquery.Value, []bigquery.Value)
+}
+
+// newRows wraps a RowIterator so that result pages are fetched lazily as Next is called.
+// On the jobs.query fast path the schema is only known once the first page has been
+// fetched, in which case the first row is read ahead and returned by the first Next.
+func newRows(ctx context.Context, c *Conn, it *bigquery.RowIterator, query string) (*rows, error) {
+	r := &rows{
+		it:          it,
+		conn:        c,
+		query:       query,
+		notices:     noticesFromContext(ctx),
+		unnestIndex: -1,
+	}
+	r.converter = ValueConverter{
+		LosslessNumeric:  c.cfg.LosslessNumeric,
+		Location:         c.location,
+		GeoJSON:          c.cfg.GeoJSON,
+		precisionLost:    r.precisionLost,
+		invalidGeography: r.invalidGeography,
+	}
+
+	if it.Schema == nil {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err != nil && err != iterator.Done {
+			return nil, err
+		}
+		r.peeked = row
+	}
+
+	for _, column := range it.Schema {
+		r.columns = append(r.columns, column.Name)
+		r.fieldSchemas = append(r.fieldSchemas, column)
+		r.types = append(r.types, fmt.Sprintf("%v", column.Type))
+	}
+
+	if c.cfg.UnnestArrays != "" {
+		if err := r.unnest(c.cfg.UnnestArrays); err != nil {
+			return nil, err
+		}
+	}
+	r.deriveColumns()
+
+	return r, nil
 }
 
 func (r *rows) Columns() []string {
 	return r.columns
 }
 
+// Close releases the iterator of the rows, the connection stays open for the next queries
 func (r *rows) Close() error {
-	return r.conn.Close()
+	r.it = nil
+	r.peeked = nil
+	r.expanded = nil
+	return nil
 }
 
-func (r *rows) Next(dest []driver.Value) error {
+func (r *rows) nextRow() ([]bigquery.Value, error) {
+	if r.peeked != nil {
+		row := r.peeked
+		r.peeked = nil
+		return row, nil
+	}
 
-	if r.rs.num == len(r.rs.data) {
-		return io.EOF
+	if r.it == nil {
+		return nil, io.EOF
 	}
 
-	for i, bgValue := range r.rs.data[r.rs.num] {
-		res, err := ConvertColumnValue(bgValue, r.fieldSchemas[i])
+	var row []bigquery.Value
+	err := r.it.Next(&row)
+	if err == iterator.Done {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// nextExpandedRow returns the next row once the array column has been unnested, if any
+func (r *rows) nextExpandedRow() ([]bigquery.Value, error) {
+	if len(r.expanded) == 0 && r.unnestIndex >= 0 {
+		row, err := r.nextRow()
+		if err != nil {
+			return nil, err
+		}
+		r.expanded = unnestRow(row, r.unnestIndex)
+	}
+
+	if len(r.expanded) > 0 {
+		row := r.expanded[0]
+		r.expanded = r.expanded[1:]
+		return row, nil
+	}
+	return r.nextRow()
+}
+
+// deriveColumns adds the columns computed from other columns: the length in seconds after INTERVAL
+// columns, so that intervals can be computed with, the start and end after RANGE columns, so that
+// they can be used as times, and the latitude and longitude after GEOGRAPHY columns converted to
+// GeoJSON, so that points can be placed on a map
+func (r *rows) deriveColumns() {
+	for i := len(r.fieldSchemas) - 1; i >= 0; i-- {
+		fieldSchema := r.fieldSchemas[i]
+		if fieldSchema.Repeated {
+			continue
+		}
+
+		switch {
+		case fieldSchema.Type == bigquery.IntervalFieldType:
+			r.addDerivedColumns(i, []*bigquery.FieldSchema{
+				{Name: fieldSchema.Name + "_seconds", Type: bigquery.FloatFieldType},
+			}, intervalSecondsValues)
+		case fieldSchema.Type == bigquery.RangeFieldType && fieldSchema.RangeElementType != nil:
+			r.addDerivedColumns(i, []*bigquery.FieldSchema{
+				{Name: fieldSchema.Name + "_start", Type: fieldSchema.RangeElementType.Type},
+				{Name: fieldSchema.Name + "_end", Type: fieldSchema.RangeElementType.Type},
+			}, rangeBoundValues)
+		case fieldSchema.Type == bigquery.GeographyFieldType && r.converter.GeoJSON:
+			r.addDerivedColumns(i, []*bigquery.FieldSchema{
+				{Name: fieldSchema.Name + "_latitude", Type: bigquery.FloatFieldType},
+				{Name: fieldSchema.Name + "_longitude", Type: bigquery.FloatFieldType},
+			}, pointValues)
+		}
+	}
+}
+
+// addDerivedColumns adds columns after the column at index. Columns are added from the last one,
+// the columns derived after index are shifted by the added columns.
+func (r *rows) addDerivedColumns(index int, fieldSchemas []*bigquery.FieldSchema, values func(v bigquery.Value) (bigquery.Value, []bigquery.Value)) {
+	columns := []string{r.columns[index]}
+	columnTypes := []string{r.types[index]}
+	for _, fieldSchema := range fieldSchemas {
+		columns = append(columns, fieldSchema.Name)
+		columnTypes = append(columnTypes, string(fieldSchema.Type))
+	}
+
+	r.columns = splice(r.columns, index, columns)
+	r.fieldSchemas = splice(r.fieldSchemas, index, append([]*bigquery.FieldSchema{r.fieldSchemas[index]}, fieldSchemas...))
+	r.types = splice(r.types, index, columnTypes)
+	for n := range r.derived {
+		r.derived[n].index += len(fieldSchemas)
+	}
+	r.derived = append([]derivedColumns{{index: index, values: values}}, r.derived...)
+}
+
+// deriveValues adds the values of the derived columns to a row
+func (r *rows) deriveValues(row []bigquery.Value) []bigquery.Value {
+	for _, derived := range r.derived {
+		v, values := derived.values(row[derived.index])
+		row = splice(row, derived.index, append([]bigquery.Value{v}, values...))
+	}
+	return row
+}
+
+func intervalSecondsValues(v bigquery.Value) (bigquery.Value, []bigquery.Value) {
+	if iv, ok := v.(*bigquery.IntervalValue); ok && iv != nil {
+		return v, []bigquery.Value{intervalSeconds(iv)}
+	}
+	return v, []bigquery.Value{nil}
+}
+
+// rangeBoundValues are the start and end of ranges, NULLs for unbounded ones
+func rangeBoundValues(v bigquery.Value) (bigquery.Value, []bigquery.Value) {
+	if rv, ok := v.(*bigquery.RangeValue); ok && rv != nil {
+		return v, []bigquery.Value{rv.Start, rv.End}
+	}
+	return v, []bigquery.Value{nil, nil}
+}
+
+// pointValues are the latitude and longitude of POINT geographies, and NULLs for other geographies.
+// The geography is parsed once, its conversion to GeoJSON reuses the parsed geometry.
+func pointValues(v bigquery.Value) (bigquery.Value, []bigquery.Value) {
+	wkt, ok := v.(string)
+	if !ok {
+		return v, []bigquery.Value{nil, nil}
+	}
+
+	g := parseGeography(wkt)
+	if longitude, latitude, ok := g.point(); ok {
+		return g, []bigquery.Value{latitude, longitude}
+	}
+	return g, []bigquery.Value{nil, nil}
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	row, err := r.nextExpandedRow()
+	if err != nil {
+		return err
+	}
+	row = r.deriveValues(row)
+
+	for i, bgValue := range row {
+		res, err := r.converter.ConvertColumnValue(bgValue, r.fieldSchemas[i])
 
 		if err != nil {
 			return err
@@ -56,14 +256,107 @@ func (r *rows) Next(dest []driver.Value) error {
 			dest[i] = res
 		}
 	}
-	r.rs.num++
 	return nil
 }
 
+// precisionLost warns that values of a column were rounded when converted to float64
+func (r *rows) precisionLost(fieldSchema *bigquery.FieldSchema) {
+	r.notices.add(r.query, data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text: fmt.Sprintf("%s values of column %s were rounded to fit a 64-bit float, "+
+			"enable losslessNumeric in the data source settings to get them as exact decimal strings", fieldSchema.Type, fieldSchema.Name),
+	})
+}
+
+// rowLimitReached warns that the rows of the result past the row limit were left out
+func (r *rows) rowLimitReached() {
+	r.notices.add(r.query, data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     fmt.Sprintf("Results have been limited to %d rows, the row limit of the data source", r.conn.cfg.RowLimit),
+	})
+}
+
+// invalidGeography warns that values of a column weren't valid WKT and were returned as NULLs
+func (r *rows) invalidGeography(fieldSchema *bigquery.FieldSchema, err error) {
+	log.DefaultLogger.Debug("Invalid GEOGRAPHY value", "column", fieldSchema.Name, "err", err)
+	r.notices.add(r.query, data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     fmt.Sprintf("Some GEOGRAPHY values of column %s couldn't be converted to GeoJSON and were returned as null", fieldSchema.Name),
+	})
+}
+
+// ColumnTypeDatabaseTypeName is the BigQuery type of the column. Array columns are JSON encoded,
+// their type is reported as ARRAY<type> so they aren't mistaken for columns of their element type.
 func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	if r.fieldSchemas[index].Repeated {
+		return fmt.Sprintf("ARRAY<%s>", r.types[index])
+	}
 	return r.types[index]
 }
 
+// ColumnTypeNullable tells whether the column may hold NULLs. Columns which are REQUIRED in BigQuery
+// are still nullable when their values may be converted to NULLs: invalid DATEs and GEOGRAPHY values
+// that can't be converted to GeoJSON.
+func (r *rows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	fieldSchema := r.fieldSchemas[index]
+	switch {
+	case !fieldSchema.Required:
+		return true, true
+	case fieldSchema.Type == bigquery.DateFieldType:
+		return true, true
+	case fieldSchema.Type == bigquery.GeographyFieldType && r.converter.GeoJSON:
+		return true, true
+	default:
+		return false, true
+	}
+}
+
+// ColumnTypePrecisionScale is the precision and scale of NUMERIC and BIGNUMERIC columns, the
+// precision and scale they are declared with or the defaults of their types otherwise
+func (r *rows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	fieldSchema := r.fieldSchemas[index]
+	if fieldSchema.Repeated {
+		return 0, 0, false
+	}
+
+	switch fieldSchema.Type {
+	case bigquery.NumericFieldType:
+		precision, scale = numericPrecision, numericScale
+	case bigquery.BigNumericFieldType:
+		precision, scale = bigNumericPrecision, bigNumericScale
+	default:
+		return 0, 0, false
+	}
+	if fieldSchema.Precision > 0 {
+		precision, scale = fieldSchema.Precision, fieldSchema.Scale
+	}
+	return precision, scale, true
+}
+
+// ColumnTypeLength is the maximum length of STRING and BYTES columns, math.MaxInt64 unless they
+// are declared with a maximum length. BYTES values are base64 encoded, the length is the encoded one.
+func (r *rows) ColumnTypeLength(index int) (length int64, ok bool) {
+	fieldSchema := r.fieldSchemas[index]
+	if fieldSchema.Repeated {
+		return 0, false
+	}
+
+	switch fieldSchema.Type {
+	case bigquery.StringFieldType:
+		if fieldSchema.MaxLength > 0 {
+			return fieldSchema.MaxLength, true
+		}
+		return math.MaxInt64, true
+	case bigquery.BytesFieldType:
+		if fieldSchema.MaxLength > 0 {
+			return int64(base64.StdEncoding.EncodedLen(int(fieldSchema.MaxLength))), true
+		}
+		return math.MaxInt64, true
+	default:
+		return 0, false
+	}
+}
+
 func (r *rows) bigqueryTypeOf(columnType *string) (reflect.Type, error) {
 	switch *columnType {
 	case "TINYINT", "SMALLINT", "INT", "INTEGER", "INT64":
@@ -76,9 +369,11 @@ func (r *rows) bigqueryTypeOf(columnType *string) (reflect.Type, error) {
 		return reflect.TypeOf(false), nil
 	case "TIMESTAMP":
 		return reflect.TypeOf(time.Time{}), nil
-	case "DATE", "TIME", "DATETIME":
-		return reflect.TypeOf(""), nil
-	case "RECORD", "GEOGRAPHY":
+	case "DATE", "DATETIME":
+		return reflect.TypeOf(time.Time{}), nil
+	case "TIME":
+		return reflect.TypeOf(time.Duration(0)), nil
+	case "RECORD", "GEOGRAPHY", "JSON", "INTERVAL", "RANGE":
 		return reflect.TypeOf(""), nil
 	default:
 		return nil, fmt.Errorf("unknown column type `%s`", *columnType)
@@ -92,6 +387,10 @@ func (r *rows) ColumnTypeScanType(index int) reflect.Type {
 		return reflect.TypeOf("")
 	}
 
+	if r.converter.LosslessNumeric && (columnType == "NUMERIC" || columnType == "BIGNUMERIC") {
+		return reflect.TypeOf("")
+	}
+
 	convertedBigqueryData, err := r.bigqueryTypeOf(&columnType)
 	if err != nil {
 		log.DefaultLogger.Error(err.Error())
@@ -0,0 +1,376 @@
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_rows_streamsPages(t *testing.T) {
+	fake, client := newFakeBigQuery(t)
+	fake.handleQueryJob(t, &fakeQueryJob{
+		fields: []map[string]interface{}{{"name": "id", "type": "INTEGER"}},
+		pages: [][]map[string]interface{}{
+			fakeRows([]interface{}{"1"}, []interface{}{"2"}),
+			fakeRows([]interface{}{"3"}),
+		},
+	})
+
+	conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+	require.NoError(t, err)
+
+	res, err := conn.QueryContext(context.Background(), "SELECT id FROM t", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id"}, res.Columns())
+	// waiting for the job and reading it
+	readsBeforeRows := fake.count("GET /projects/test-project/queries/*")
+
+	dest := make([]driver.Value, 1)
+	require.NoError(t, res.Next(dest))
+	assert.Equal(t, int64(1), dest[0])
+	require.NoError(t, res.Next(dest))
+	assert.Equal(t, int64(2), dest[0])
+	assert.Equal(t, readsBeforeRows+1, fake.count("GET /projects/test-project/queries/*"), "second page must not be fetched before it is needed")
+
+	require.NoError(t, res.Next(dest))
+	assert.Equal(t, int64(3), dest[0])
+	assert.Equal(t, readsBeforeRows+2, fake.count("GET /projects/test-project/queries/*"))
+
+	assert.Equal(t, io.EOF, res.Next(dest))
+}
+
+func Test_rows_emptyResult(t *testing.T) {
+	fake, client := newFakeBigQuery(t)
+	fake.handleQueryJob(t, &fakeQueryJob{
+		fields: []map[string]interface{}{{"name": "name", "type": "STRING"}},
+	})
+
+	conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+	require.NoError(t, err)
+
+	res, err := conn.QueryContext(context.Background(), "SELECT name FROM t", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"name"}, res.Columns())
+	assert.Equal(t, io.EOF, res.Next(make([]driver.Value, 1)))
+}
+
+func Test_rows_numericPrecision(t *testing.T) {
+	job := &fakeQueryJob{
+		fields: []map[string]interface{}{{"name": "amount", "type": "BIGNUMERIC"}},
+		pages: [][]map[string]interface{}{
+			fakeRows([]interface{}{"0.1"}, []interface{}{"12345678901234567890.123456789"}),
+		},
+	}
+
+	t.Run("rounded values raise a notice", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, job)
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+		require.NoError(t, err)
+
+		ctx, notices := WithNotices(context.Background())
+		res, err := conn.QueryContext(ctx, "SELECT amount FROM t", nil)
+		require.NoError(t, err)
+		assert.Equal(t, reflect.TypeOf(float64(0)), res.(*rows).ColumnTypeScanType(0))
+
+		dest := make([]driver.Value, 1)
+		require.NoError(t, res.Next(dest))
+		assert.Equal(t, 0.1, dest[0])
+		assert.Empty(t, notices.For("SELECT amount FROM t"))
+
+		require.NoError(t, res.Next(dest))
+		require.Len(t, notices.For("SELECT amount FROM t"), 1)
+		assert.Equal(t, data.NoticeSeverityWarning, notices.For("SELECT amount FROM t")[0].Severity)
+		assert.Contains(t, notices.For("SELECT amount FROM t")[0].Text, "column amount")
+	})
+
+	t.Run("lossless mode returns decimal strings", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, job)
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{LosslessNumeric: true}, client)
+		require.NoError(t, err)
+
+		ctx, notices := WithNotices(context.Background())
+		res, err := conn.QueryContext(ctx, "SELECT amount FROM t", nil)
+		require.NoError(t, err)
+		assert.Equal(t, reflect.TypeOf(""), res.(*rows).ColumnTypeScanType(0))
+
+		dest := make([]driver.Value, 1)
+		require.NoError(t, res.Next(dest))
+		assert.Equal(t, "0.1", dest[0])
+		require.NoError(t, res.Next(dest))
+		assert.Equal(t, "12345678901234567890.123456789", dest[0])
+		assert.Empty(t, notices.For("SELECT amount FROM t"))
+	})
+}
+
+func Test_rows_unnestArrays(t *testing.T) {
+	fakeArray := func(values ...string) []interface{} {
+		res := make([]interface{}, len(values))
+		for i, v := range values {
+			res[i] = map[string]interface{}{"v": v}
+		}
+		return res
+	}
+	job := &fakeQueryJob{
+		fields: []map[string]interface{}{
+			{"name": "name", "type": "STRING"},
+			{"name": "values", "type": "INTEGER", "mode": "REPEATED"},
+		},
+		pages: [][]map[string]interface{}{
+			fakeRows([]interface{}{"a", fakeArray("1", "2")}, []interface{}{"b", fakeArray()}),
+			fakeRows([]interface{}{"c", fakeArray("3", "4", "5")}),
+		},
+	}
+
+	readAll := func(t *testing.T, res driver.Rows) [][]driver.Value {
+		t.Helper()
+		var all [][]driver.Value
+		for {
+			dest := make([]driver.Value, len(res.Columns()))
+			err := res.Next(dest)
+			if err == io.EOF {
+				return all
+			}
+			require.NoError(t, err)
+			all = append(all, dest)
+		}
+	}
+
+	t.Run("arrays are JSON by default", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, job)
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+		require.NoError(t, err)
+
+		res, err := conn.QueryContext(context.Background(), "SELECT name, values FROM t", nil)
+		require.NoError(t, err)
+		assert.Equal(t, [][]driver.Value{{"a", "[1,2]"}, {"b", "[]"}, {"c", "[3,4,5]"}}, readAll(t, res))
+	})
+
+	t.Run("unnest into rows", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, job)
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{UnnestArrays: types.UnnestRows}, client)
+		require.NoError(t, err)
+
+		res, err := conn.QueryContext(context.Background(), "SELECT name, values FROM t", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"name", "values"}, res.Columns())
+		assert.Equal(t, reflect.TypeOf(int64(0)), res.(*rows).ColumnTypeScanType(1))
+		assert.Equal(t, [][]driver.Value{
+			{"a", int64(1)}, {"a", int64(2)},
+			{"b", nil},
+			{"c", int64(3)}, {"c", int64(4)}, {"c", int64(5)},
+		}, readAll(t, res))
+	})
+
+	t.Run("unnest into columns", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, job)
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{UnnestArrays: types.UnnestColumns}, client)
+		require.NoError(t, err)
+
+		res, err := conn.QueryContext(context.Background(), "SELECT name, values FROM t", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"name", "values[0]", "values[1]", "values[2]"}, res.Columns())
+		assert.Equal(t, reflect.TypeOf(int64(0)), res.(*rows).ColumnTypeScanType(3))
+		assert.Equal(t, [][]driver.Value{
+			{"a", int64(1), int64(2), nil},
+			{"b", nil, nil, nil},
+			{"c", int64(3), int64(4), int64(5)},
+		}, readAll(t, res))
+	})
+
+	t.Run("unnest into columns up to the row limit", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, job)
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{UnnestArrays: types.UnnestColumns, RowLimit: 2}, client)
+		require.NoError(t, err)
+
+		_, err = conn.QueryContext(context.Background(), "SELECT name, values FROM t", nil)
+		assert.ErrorContains(t, err, "the result has more than 2 rows")
+	})
+
+	t.Run("unknown mode", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, job)
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{UnnestArrays: "diagonal"}, client)
+		require.NoError(t, err)
+
+		_, err = conn.QueryContext(context.Background(), "SELECT name, values FROM t", nil)
+		assert.ErrorContains(t, err, `unknown unnestArrays mode "diagonal"`)
+	})
+}
+
+func Test_rows_intervalSeconds(t *testing.T) {
+	fake, client := newFakeBigQuery(t)
+	fake.handleQueryJob(t, &fakeQueryJob{
+		fields: []map[string]interface{}{
+			{"name": "wait", "type": "INTERVAL"},
+			{"name": "name", "type": "STRING"},
+			{"name": "run", "type": "INTERVAL"},
+		},
+		pages: [][]map[string]interface{}{
+			fakeRows([]interface{}{"0-0 1 2:0:0", "a", nil}),
+		},
+	})
+	conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+	require.NoError(t, err)
+
+	res, err := conn.QueryContext(context.Background(), "SELECT wait, name, run FROM t", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"wait", "wait_seconds", "name", "run", "run_seconds"}, res.Columns())
+	assert.Equal(t, reflect.TypeOf(""), res.(*rows).ColumnTypeScanType(0))
+	assert.Equal(t, reflect.TypeOf(float64(0)), res.(*rows).ColumnTypeScanType(1))
+
+	dest := make([]driver.Value, 5)
+	require.NoError(t, res.Next(dest))
+	assert.Equal(t, []driver.Value{"0-0 1 2:0:0", float64(26 * 60 * 60), "a", nil, nil}, dest)
+}
+
+func Test_rows_rangeColumns(t *testing.T) {
+	fake, client := newFakeBigQuery(t)
+	fake.handleQueryJob(t, &fakeQueryJob{
+		fields: []map[string]interface{}{
+			{"name": "period", "type": "RANGE", "rangeElementType": map[string]interface{}{"type": "DATE"}},
+			{"name": "window", "type": "RANGE", "rangeElementType": map[string]interface{}{"type": "TIMESTAMP"}},
+		},
+		pages: [][]map[string]interface{}{
+			fakeRows(
+				[]interface{}{"[2024-01-01, 2024-02-01)", "[1700000000000000, UNBOUNDED)"},
+				[]interface{}{nil, "[UNBOUNDED, 1700000060000000)"},
+			),
+		},
+	})
+	conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+	require.NoError(t, err)
+
+	res, err := conn.QueryContext(context.Background(), "SELECT period, window FROM t", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"period", "period_start", "period_end", "window", "window_start", "window_end"}, res.Columns())
+	assert.Equal(t, reflect.TypeOf(""), res.(*rows).ColumnTypeScanType(0))
+	assert.Equal(t, reflect.TypeOf(time.Time{}), res.(*rows).ColumnTypeScanType(1))
+	assert.Equal(t, reflect.TypeOf(time.Time{}), res.(*rows).ColumnTypeScanType(5))
+
+	start := time.Unix(1700000000, 0).UTC()
+	end := time.Unix(1700000060, 0).UTC()
+	dest := make([]driver.Value, 6)
+	require.NoError(t, res.Next(dest))
+	assert.Equal(t, []driver.Value{
+		"[2024-01-01, 2024-02-01)", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		"[2023-11-14 22:13:20 UTC, UNBOUNDED)", start, nil,
+	}, dest)
+	require.NoError(t, res.Next(dest))
+	assert.Equal(t, []driver.Value{nil, nil, nil, "[UNBOUNDED, 2023-11-14 22:14:20 UTC)", nil, end}, dest)
+}
+
+func Test_rows_geoJSON(t *testing.T) {
+	fake, client := newFakeBigQuery(t)
+	fake.handleQueryJob(t, &fakeQueryJob{
+		fields: []map[string]interface{}{
+			{"name": "place", "type": "GEOGRAPHY"},
+			{"name": "name", "type": "STRING"},
+		},
+		pages: [][]map[string]interface{}{
+			fakeRows(
+				[]interface{}{"POINT(2.35 48.85)", "paris"},
+				[]interface{}{"LINESTRING(1 2, 3 4)", "line"},
+				[]interface{}{"POINT(oops)", "broken"},
+			),
+		},
+	})
+	conn, err := NewConn(context.Background(), types.ConnectionSettings{GeoJSON: true}, client)
+	require.NoError(t, err)
+
+	ctx, notices := WithNotices(context.Background())
+	res, err := conn.QueryContext(ctx, "SELECT place, name FROM t", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"place", "place_latitude", "place_longitude", "name"}, res.Columns())
+
+	dest := make([]driver.Value, 4)
+	require.NoError(t, res.Next(dest))
+	assert.Equal(t, []driver.Value{`{"coordinates":[2.35,48.85],"type":"Point"}`, 48.85, 2.35, "paris"}, dest)
+	require.NoError(t, res.Next(dest))
+	assert.Equal(t, []driver.Value{`{"coordinates":[[1,2],[3,4]],"type":"LineString"}`, nil, nil, "line"}, dest)
+	assert.Empty(t, notices.For("SELECT place, name FROM t"))
+
+	require.NoError(t, res.Next(dest))
+	assert.Equal(t, []driver.Value{nil, nil, nil, "broken"}, dest)
+	require.Len(t, notices.For("SELECT place, name FROM t"), 1)
+	assert.Contains(t, notices.For("SELECT place, name FROM t")[0].Text, "column place")
+}
+
+func Test_rows_columnTypes(t *testing.T) {
+	fake, client := newFakeBigQuery(t)
+	fake.handleQueryJob(t, &fakeQueryJob{
+		fields: []map[string]interface{}{
+			{"name": "id", "type": "INTEGER", "mode": "REQUIRED"},
+			{"name": "name", "type": "STRING", "maxLength": "10"},
+			{"name": "comment", "type": "STRING"},
+			{"name": "hash", "type": "BYTES", "mode": "REQUIRED", "maxLength": "32"},
+			{"name": "price", "type": "NUMERIC", "precision": "10", "scale": "2"},
+			{"name": "total", "type": "BIGNUMERIC"},
+			{"name": "day", "type": "DATE", "mode": "REQUIRED"},
+			{"name": "tags", "type": "STRING", "mode": "REPEATED"},
+		},
+	})
+	conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+	require.NoError(t, err)
+
+	res, err := conn.QueryContext(context.Background(), "SELECT * FROM t", nil)
+	require.NoError(t, err)
+	require.Implements(t, (*driver.RowsColumnTypeNullable)(nil), res)
+	require.Implements(t, (*driver.RowsColumnTypePrecisionScale)(nil), res)
+	require.Implements(t, (*driver.RowsColumnTypeLength)(nil), res)
+	r := res.(*rows)
+
+	t.Run("nullable", func(t *testing.T) {
+		for index, expected := range []bool{false, true, true, false, true, true, true, true} {
+			nullable, ok := r.ColumnTypeNullable(index)
+			assert.True(t, ok)
+			assert.Equal(t, expected, nullable, r.columns[index])
+		}
+	})
+
+	t.Run("precision and scale", func(t *testing.T) {
+		precision, scale, ok := r.ColumnTypePrecisionScale(4)
+		assert.True(t, ok)
+		assert.Equal(t, []int64{10, 2}, []int64{precision, scale})
+
+		precision, scale, ok = r.ColumnTypePrecisionScale(5)
+		assert.True(t, ok)
+		assert.Equal(t, []int64{76, 38}, []int64{precision, scale})
+
+		_, _, ok = r.ColumnTypePrecisionScale(0)
+		assert.False(t, ok)
+	})
+
+	t.Run("length", func(t *testing.T) {
+		length, ok := r.ColumnTypeLength(1)
+		assert.True(t, ok)
+		assert.Equal(t, int64(10), length)
+
+		length, ok = r.ColumnTypeLength(2)
+		assert.True(t, ok)
+		assert.Equal(t, int64(math.MaxInt64), length)
+
+		length, ok = r.ColumnTypeLength(3)
+		assert.True(t, ok)
+		assert.Equal(t, int64(44), length, "base64 encoded length")
+
+		_, ok = r.ColumnTypeLength(0)
+		assert.False(t, ok)
+		_, ok = r.ColumnTypeLength(7)
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,195 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"google.golang.org/api/iterator"
+)
+
+// scriptStatementType is the statement type of the parent job of a multi-statement script
+const scriptStatementType = "SCRIPT"
+
+// ScriptStats collects the statistics of the statements of multi-statement scripts, so that they can
+// be attached to the frames of those scripts. Statistics are kept per executed query string.
+type ScriptStats struct {
+	mu      sync.Mutex
+	byQuery map[string][]data.QueryStat
+}
+
+type scriptStatsKey struct{}
+
+// WithScriptStats returns a context collecting the statistics of the scripts run with it
+func WithScriptStats(ctx context.Context) (context.Context, *ScriptStats) {
+	stats := &ScriptStats{byQuery: map[string][]data.QueryStat{}}
+	return context.WithValue(ctx, scriptStatsKey{}, stats), stats
+}
+
+func scriptStatsFromContext(ctx context.Context) *ScriptStats {
+	stats, _ := ctx.Value(scriptStatsKey{}).(*ScriptStats)
+	return stats
+}
+
+// add records the statistics of a script. It is a no-op on nil ScriptStats.
+func (s *ScriptStats) add(query string, stats []data.QueryStat) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byQuery[query] = stats
+}
+
+// For returns the statistics recorded for a script
+func (s *ScriptStats) For(query string) []data.QueryStat {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byQuery[query]
+}
+
+// isScript tells whether a job ran a multi-statement script
+func isScript(status *bigquery.JobStatus) bool {
+	if status == nil || status.Statistics == nil {
+		return false
+	}
+	if status.Statistics.NumChildJobs > 0 {
+		return true
+	}
+	statistics, ok := status.Statistics.Details.(*bigquery.QueryStatistics)
+	return ok && statistics.StatementType == scriptStatementType
+}
+
+// childJobs lists the jobs of the statements run by a script, in the order they ran. Jobs are
+// listed from the most recent one, statements of loops and procedures each have a job.
+func childJobs(ctx context.Context, job *bigquery.Job) ([]*bigquery.Job, error) {
+	var children []*bigquery.Job
+	it := job.Children(ctx)
+	for {
+		child, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		children = append([]*bigquery.Job{child}, children...)
+	}
+
+	sort.SliceStable(children, func(i, j int) bool {
+		return creationTime(children[i]).Before(creationTime(children[j]))
+	})
+	return children, nil
+}
+
+func creationTime(job *bigquery.Job) (t time.Time) {
+	if status := job.LastStatus(); status != nil && status.Statistics != nil {
+		t = status.Statistics.CreationTime
+	}
+	return t
+}
+
+// lastSelect is the last statement of a script which returned rows, its result is the result of the script
+func lastSelect(children []*bigquery.Job) *bigquery.Job {
+	for i := len(children) - 1; i >= 0; i-- {
+		status := children[i].LastStatus()
+		if status == nil || status.Statistics == nil {
+			continue
+		}
+		if statistics, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok && statistics.StatementType == "SELECT" {
+			return children[i]
+		}
+	}
+	return nil
+}
+
+// scriptStats are the bytes processed, slot time and duration of each statement of a script
+func scriptStats(children []*bigquery.Job) []data.QueryStat {
+	var stats []data.QueryStat
+	for i, child := range children {
+		status := child.LastStatus()
+		if status == nil || status.Statistics == nil {
+			continue
+		}
+
+		name := fmt.Sprintf("Statement %d", i+1)
+		var slotMillis int64
+		if statistics, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+			if statistics.StatementType != "" {
+				name = fmt.Sprintf("%s (%s)", name, statistics.StatementType)
+			}
+			slotMillis = statistics.SlotMillis
+		}
+
+		stats = append(stats,
+			data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: name + " bytes processed", Unit: "decbytes"}, Value: float64(status.Statistics.TotalBytesProcessed)},
+			data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: name + " slot time", Unit: "ms"}, Value: float64(slotMillis)},
+		)
+		if !status.Statistics.StartTime.IsZero() && !status.Statistics.EndTime.IsZero() {
+			duration := status.Statistics.EndTime.Sub(status.Statistics.StartTime)
+			stats = append(stats, data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: name + " duration", Unit: "ms"}, Value: float64(duration.Milliseconds())})
+		}
+	}
+	return stats
+}
+
+// scriptResult is the job whose result is the result of a script: the last statement which returned
+// rows, or the script itself if none did. The statistics of the statements are recorded for the script.
+func scriptResult(ctx context.Context, job *bigquery.Job, status *bigquery.JobStatus, query string) (*bigquery.Job, *bigquery.JobStatus, error) {
+	children, err := childJobs(ctx, job)
+	if err != nil {
+		return nil, nil, err
+	}
+	scriptStatsFromContext(ctx).add(query, scriptStats(children))
+
+	if last := lastSelect(children); last != nil {
+		return last, last.LastStatus(), nil
+	}
+	return job, status, nil
+}
+
+// scriptError tells which statement of a script made it fail. The error is returned as is if the job
+// didn't run a script, or if the failed statement can't be found.
+func scriptError(ctx context.Context, job *bigquery.Job, status *bigquery.JobStatus, err error) error {
+	if status == nil {
+		var statusErr error
+		if status, statusErr = job.Status(ctx); statusErr != nil {
+			return err
+		}
+	}
+	if !isScript(status) {
+		return err
+	}
+
+	children, listErr := childJobs(ctx, job)
+	if listErr != nil {
+		log.DefaultLogger.Warn("Failed to list the statements of a failed script", "job", job.ID(), "err", listErr)
+		return err
+	}
+
+	for i, child := range children {
+		childStatus := child.LastStatus()
+		if childStatus == nil || childStatus.Err() == nil {
+			continue
+		}
+
+		scriptErr := &ScriptError{Statement: i + 1, Err: err}
+		if childStatus.Statistics != nil && childStatus.Statistics.ScriptStatistics != nil {
+			if frames := childStatus.Statistics.ScriptStatistics.StackFrames; len(frames) > 0 && frames[0] != nil {
+				scriptErr.Line, scriptErr.Column = frames[0].StartLine, frames[0].StartColumn
+			}
+		}
+		return scriptErr
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeChildJob is the representation of a child job of a script in jobs.list responses
+func fakeChildJob(id string, statementType string, creationTime int64, status map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"jobReference": map[string]interface{}{"projectId": "test-project", "jobId": id, "location": "US"},
+		"configuration": map[string]interface{}{"query": map[string]interface{}{
+			"query":            "statement",
+			"destinationTable": map[string]interface{}{"projectId": "test-project", "datasetId": "_script", "tableId": id},
+		}},
+		"status": status,
+		"statistics": map[string]interface{}{
+			"creationTime":        strconv.FormatInt(creationTime, 10),
+			"startTime":           strconv.FormatInt(creationTime, 10),
+			"endTime":             strconv.FormatInt(creationTime+500, 10),
+			"totalBytesProcessed": "2048",
+			"query":               map[string]interface{}{"statementType": statementType, "totalSlotMs": "40"},
+		},
+	}
+}
+
+func Test_queryContext_script(t *testing.T) {
+	const script = "DECLARE n INT64 DEFAULT 2; CREATE TEMP TABLE t AS SELECT n AS id; SELECT id FROM t"
+
+	t.Run("returns the rows of the last SELECT with the statistics of the statements", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handle("GET /projects/test-project/queries/child-3", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]interface{}{
+				"jobComplete": true,
+				"schema":      map[string]interface{}{"fields": []map[string]interface{}{{"name": "id", "type": "INTEGER"}}},
+				"totalRows":   "1",
+				"rows":        fakeRows([]interface{}{"2"}),
+			})
+		})
+		fake.handle("GET /projects/test-project/jobs", func(w http.ResponseWriter, r *http.Request) {
+			assert.NotEmpty(t, r.URL.Query().Get("parentJobId"))
+			done := map[string]interface{}{"state": "DONE"}
+			// jobs are listed from the most recent one
+			writeJSON(w, map[string]interface{}{"jobs": []map[string]interface{}{
+				fakeChildJob("child-3", "SELECT", 1700000000003, done),
+				fakeChildJob("child-2", "CREATE_TABLE_AS_SELECT", 1700000000002, done),
+				fakeChildJob("child-1", "DECLARE", 1700000000001, done),
+			}})
+		})
+		fake.handleQueryJob(t, &fakeQueryJob{
+			fields:     []map[string]interface{}{{"name": "parent", "type": "STRING"}},
+			statistics: map[string]interface{}{"numChildJobs": "3", "query": map[string]interface{}{"statementType": "SCRIPT"}},
+		})
+
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+		require.NoError(t, err)
+
+		ctx, scriptStats := WithScriptStats(context.Background())
+		res, err := conn.QueryContext(ctx, script, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"id"}, res.Columns())
+		dest := make([]driver.Value, 1)
+		require.NoError(t, res.Next(dest))
+		assert.Equal(t, int64(2), dest[0])
+
+		stats := scriptStats.For(script)
+		require.Len(t, stats, 9)
+		assert.Equal(t, "Statement 1 (DECLARE) bytes processed", stats[0].DisplayName)
+		assert.Equal(t, float64(2048), stats[0].Value)
+		assert.Equal(t, "Statement 2 (CREATE_TABLE_AS_SELECT) slot time", stats[4].DisplayName)
+		assert.Equal(t, float64(40), stats[4].Value)
+		assert.Equal(t, "Statement 3 (SELECT) duration", stats[8].DisplayName)
+	})
+
+	t.Run("reports which statement failed", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handle("GET /projects/test-project/jobs", func(w http.ResponseWriter, r *http.Request) {
+			failed := fakeChildJob("child-2", "CREATE_TABLE_AS_SELECT", 1700000000002, map[string]interface{}{
+				"state":       "DONE",
+				"errorResult": map[string]interface{}{"reason": "invalidQuery", "message": "Unrecognized name: m"},
+			})
+			failed["statistics"].(map[string]interface{})["scriptStatistics"] = map[string]interface{}{
+				"stackFrames": []map[string]interface{}{{"startLine": 3, "startColumn": 5, "text": "CREATE TEMP TABLE t AS SELECT m AS id"}},
+			}
+			writeJSON(w, map[string]interface{}{"jobs": []map[string]interface{}{
+				failed,
+				fakeChildJob("child-1", "DECLARE", 1700000000001, map[string]interface{}{"state": "DONE"}),
+			}})
+		})
+		fake.handleQueryJob(t, &fakeQueryJob{
+			errorReason: "invalidQuery",
+			statistics:  map[string]interface{}{"numChildJobs": "2", "query": map[string]interface{}{"statementType": "SCRIPT"}},
+		})
+
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+		require.NoError(t, err)
+
+		_, err = conn.QueryContext(context.Background(), script, nil)
+		var scriptErr *ScriptError
+		require.True(t, errors.As(err, &scriptErr), err)
+		assert.Equal(t, 2, scriptErr.Statement)
+		assert.Equal(t, int64(3), scriptErr.Line)
+		assert.Equal(t, int64(5), scriptErr.Column)
+		assert.True(t, hasReason(err, "invalidQuery"))
+	})
+}
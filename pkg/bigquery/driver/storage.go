@@ -0,0 +1,294 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"cloud.google.com/go/civil"
+	"github.com/apache/arrow/go/v13/arrow"
+	"github.com/apache/arrow/go/v13/arrow/array"
+	"github.com/apache/arrow/go/v13/arrow/ipc"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// ReadClient reads tables with the BigQuery Storage Read API, it is implemented by storage.BigQueryReadClient
+type ReadClient interface {
+	CreateReadSession(ctx context.Context, req *storagepb.CreateReadSessionRequest, opts ...gax.CallOption) (*storagepb.ReadSession, error)
+	ReadRows(ctx context.Context, req *storagepb.ReadRowsRequest, opts ...gax.CallOption) (storagepb.BigQueryRead_ReadRowsClient, error)
+}
+
+// storageReadTypes are the column types read from the Arrow streams of the Storage Read API
+var storageReadTypes = map[bigquery.FieldType]bool{
+	bigquery.IntegerFieldType:    true,
+	bigquery.FloatFieldType:      true,
+	bigquery.BooleanFieldType:    true,
+	bigquery.StringFieldType:     true,
+	bigquery.BytesFieldType:      true,
+	bigquery.NumericFieldType:    true,
+	bigquery.BigNumericFieldType: true,
+	bigquery.TimestampFieldType:  true,
+	bigquery.DateFieldType:       true,
+	bigquery.DateTimeFieldType:   true,
+	bigquery.TimeFieldType:       true,
+	bigquery.GeographyFieldType:  true,
+	bigquery.JSONFieldType:       true,
+}
+
+// readStorage reads the result of a query job with the Storage Read API when it exceeds the
+// configured thresholds. The result is converted to a frame straight from the Arrow record
+// batches and passed on through the context, the rows are left empty. It returns false when
+// the result has to be read through the rows instead: when it is small, when its columns need
+// converting row by row or when the bigquery.readsessions permissions are missing.
+func (c *Conn) readStorage(ctx context.Context, job *bigquery.Job, r *rows, totalRows uint64) (bool, error) {
+	frames := framesFromContext(ctx)
+	if c.readClient == nil || frames == nil || c.storageDenied.Load() || !r.storageReadable() {
+		return false, nil
+	}
+
+	config, err := job.Config()
+	if err != nil {
+		return false, err
+	}
+	queryConfig, ok := config.(*bigquery.QueryConfig)
+	if !ok || queryConfig.Dst == nil {
+		return false, nil
+	}
+
+	exceeds, err := c.exceedsStorageThresholds(ctx, queryConfig.Dst, totalRows)
+	if err != nil || !exceeds {
+		return false, err
+	}
+
+	table := queryConfig.Dst
+	session, err := c.readClient.CreateReadSession(ctx, &storagepb.CreateReadSessionRequest{
+		Parent: "projects/" + c.client.Project(),
+		ReadSession: &storagepb.ReadSession{
+			Table:      fmt.Sprintf("projects/%s/datasets/%s/tables/%s", table.ProjectID, table.DatasetID, table.TableID),
+			DataFormat: storagepb.DataFormat_ARROW,
+		},
+		// A single stream keeps the rows in the order of the query
+		MaxStreamCount: 1,
+	})
+	if grpcstatus.Code(err) == codes.PermissionDenied {
+		log.DefaultLogger.Warn("Reading query results through the REST API, the Storage Read API requires the bigquery.readsessions permissions", "err", err)
+		c.storageDenied.Store(true)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	frame, err := r.readSession(ctx, c.readClient, session)
+	if err != nil {
+		return false, err
+	}
+	frames.add(r.query, frame)
+	r.it = nil
+	r.peeked = nil
+	return true, nil
+}
+
+// exceedsStorageThresholds tells whether a result has more rows or bytes than the thresholds
+// above which it is read with the Storage Read API
+func (c *Conn) exceedsStorageThresholds(ctx context.Context, table *bigquery.Table, totalRows uint64) (bool, error) {
+	if c.cfg.StorageReadRows > 0 && totalRows >= uint64(c.cfg.StorageReadRows) {
+		return true, nil
+	}
+	if c.cfg.StorageReadBytes <= 0 {
+		return false, nil
+	}
+
+	metadata, err := table.Metadata(ctx)
+	if err != nil {
+		return false, err
+	}
+	return metadata.NumBytes >= c.cfg.StorageReadBytes, nil
+}
+
+// storageReadable tells whether the columns of the result can be read from Arrow streams. Arrays,
+// records and the columns which are unnested or derived from others are read through the rows.
+func (r *rows) storageReadable() bool {
+	if r.unnestIndex >= 0 || r.unnestedColumns || len(r.derived) > 0 {
+		return false
+	}
+	for _, fieldSchema := range r.fieldSchemas {
+		if fieldSchema.Repeated || !storageReadTypes[fieldSchema.Type] {
+			return false
+		}
+		if fieldSchema.Type == bigquery.GeographyFieldType && r.converter.GeoJSON {
+			return false
+		}
+	}
+	return true
+}
+
+// readSession reads the streams of a read session into a frame, up to the row limit
+func (r *rows) readSession(ctx context.Context, client ReadClient, session *storagepb.ReadSession) (*data.Frame, error) {
+	// the streams left unread once the row limit is reached are closed by cancelling their context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	frame := r.newFrame()
+	schema := session.GetArrowSchema().GetSerializedSchema()
+	limited := false
+
+	for _, stream := range session.GetStreams() {
+		if limited {
+			break
+		}
+		rowsClient, err := client.ReadRows(ctx, &storagepb.ReadRowsRequest{ReadStream: stream.GetName()})
+		if err != nil {
+			return nil, err
+		}
+
+		for !limited {
+			res, err := rowsClient.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			limited, err = r.appendRecordBatch(frame, schema, res.GetArrowRecordBatch().GetSerializedRecordBatch())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if limited {
+		r.rowLimitReached()
+	}
+	return frame, nil
+}
+
+// newFrame creates a frame with a field per column, of the type the column would be scanned to
+func (r *rows) newFrame() *data.Frame {
+	fields := make([]*data.Field, len(r.columns))
+	for i, column := range r.columns {
+		scanType := r.ColumnTypeScanType(i)
+		fieldType := data.FieldTypeFor(reflect.Zero(scanType).Interface())
+		if scanType == reflect.TypeOf(time.Duration(0)) {
+			// TIME values are put in frames as milliseconds since midnight
+			fieldType = data.FieldTypeFloat64
+		}
+		if nullable, _ := r.ColumnTypeNullable(i); nullable {
+			fieldType = fieldType.NullableType()
+		}
+
+		fields[i] = data.NewFieldFromFieldType(fieldType, 0)
+		fields[i].Name = column
+	}
+	return data.NewFrame("", fields...)
+}
+
+// appendRecordBatch decodes a serialized Arrow record batch and appends its rows to the frame. It
+// returns true when rows of the batch were left out as the frame reached the row limit.
+func (r *rows) appendRecordBatch(frame *data.Frame, schema []byte, batch []byte) (bool, error) {
+	reader, err := ipc.NewReader(io.MultiReader(bytes.NewReader(schema), bytes.NewReader(batch)))
+	if err != nil {
+		return false, err
+	}
+	defer reader.Release()
+
+	rowLimit := int(r.conn.cfg.RowLimit)
+	for reader.Next() {
+		record := reader.Record()
+		if int(record.NumCols()) != len(frame.Fields) {
+			return false, fmt.Errorf("arrow record batch has %d columns, expected %d", record.NumCols(), len(frame.Fields))
+		}
+
+		for row := 0; row < int(record.NumRows()); row++ {
+			if rowLimit > 0 && frame.Rows() >= rowLimit {
+				return true, nil
+			}
+			for i, field := range frame.Fields {
+				v, err := arrowValue(record.Column(i), row)
+				if err != nil {
+					return false, fmt.Errorf("column %s: %w", r.columns[i], err)
+				}
+				res, err := r.converter.ConvertColumnValue(v, r.fieldSchemas[i])
+				if err != nil {
+					return false, err
+				}
+				appendFieldValue(field, res)
+			}
+		}
+	}
+	return false, reader.Err()
+}
+
+// appendFieldValue appends a converted value to a frame field, as a pointer to it if the field is nullable
+func appendFieldValue(field *data.Field, v interface{}) {
+	if v == nil {
+		field.Extend(1)
+		return
+	}
+	if d, ok := v.(time.Duration); ok {
+		v = float64(d) / float64(time.Millisecond)
+	}
+	if field.Nullable() {
+		p := reflect.New(reflect.TypeOf(v))
+		p.Elem().Set(reflect.ValueOf(v))
+		v = p.Interface()
+	}
+	field.Append(v)
+}
+
+// arrowValue reads a value of an Arrow column as the BigQuery client would have returned it.
+// See https://cloud.google.com/bigquery/docs/reference/storage#arrow_schema_details
+func arrowValue(column arrow.Array, i int) (bigquery.Value, error) {
+	if column.IsNull(i) {
+		return nil, nil
+	}
+
+	switch column := column.(type) {
+	case *array.Int64:
+		return column.Value(i), nil
+	case *array.Float64:
+		return column.Value(i), nil
+	case *array.Boolean:
+		return column.Value(i), nil
+	case *array.String:
+		return column.Value(i), nil
+	case *array.Binary:
+		return column.Value(i), nil
+	case *array.Decimal128:
+		scale := column.DataType().(*arrow.Decimal128Type).Scale
+		return decimalRat(column.Value(i).BigInt(), scale), nil
+	case *array.Decimal256:
+		scale := column.DataType().(*arrow.Decimal256Type).Scale
+		return decimalRat(column.Value(i).BigInt(), scale), nil
+	case *array.Timestamp:
+		timestampType := column.DataType().(*arrow.TimestampType)
+		t := column.Value(i).ToTime(timestampType.Unit)
+		if timestampType.TimeZone == "" {
+			// DATETIME values are timestamps without a time zone
+			return civil.DateTimeOf(t), nil
+		}
+		return t, nil
+	case *array.Date32:
+		return civil.DateOf(column.Value(i).ToTime()), nil
+	case *array.Time64:
+		return civil.TimeOf(column.Value(i).ToTime(column.DataType().(*arrow.Time64Type).Unit)), nil
+	default:
+		return nil, fmt.Errorf("unsupported Arrow type %s", column.DataType())
+	}
+}
+
+// decimalRat is the value of an unscaled decimal
+func decimalRat(unscaled *big.Int, scale int32) *big.Rat {
+	return new(big.Rat).SetFrac(unscaled, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil))
+}
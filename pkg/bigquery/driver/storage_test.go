@@ -0,0 +1,274 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"github.com/apache/arrow/go/v13/arrow"
+	"github.com/apache/arrow/go/v13/arrow/array"
+	"github.com/apache/arrow/go/v13/arrow/decimal128"
+	"github.com/apache/arrow/go/v13/arrow/ipc"
+	"github.com/apache/arrow/go/v13/arrow/memory"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// fakeReadClient serves a read session with a single stream of Arrow record batches
+type fakeReadClient struct {
+	schema  []byte
+	batches [][]byte
+	// err fails the creation of read sessions
+	err error
+
+	sessions []*storagepb.CreateReadSessionRequest
+	closed   bool
+}
+
+func (f *fakeReadClient) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *fakeReadClient) CreateReadSession(_ context.Context, req *storagepb.CreateReadSessionRequest, _ ...gax.CallOption) (*storagepb.ReadSession, error) {
+	f.sessions = append(f.sessions, req)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &storagepb.ReadSession{
+		Schema:  &storagepb.ReadSession_ArrowSchema{ArrowSchema: &storagepb.ArrowSchema{SerializedSchema: f.schema}},
+		Streams: []*storagepb.ReadStream{{Name: "stream-0"}},
+	}, nil
+}
+
+func (f *fakeReadClient) ReadRows(_ context.Context, _ *storagepb.ReadRowsRequest, _ ...gax.CallOption) (storagepb.BigQueryRead_ReadRowsClient, error) {
+	return &fakeReadRowsClient{batches: f.batches}, nil
+}
+
+type fakeReadRowsClient struct {
+	grpc.ClientStream
+	batches [][]byte
+}
+
+func (f *fakeReadRowsClient) Recv() (*storagepb.ReadRowsResponse, error) {
+	if len(f.batches) == 0 {
+		return nil, io.EOF
+	}
+	batch := f.batches[0]
+	f.batches = f.batches[1:]
+	return &storagepb.ReadRowsResponse{
+		Rows: &storagepb.ReadRowsResponse_ArrowRecordBatch{ArrowRecordBatch: &storagepb.ArrowRecordBatch{SerializedRecordBatch: batch}},
+	}, nil
+}
+
+// serializeArrow serializes records as the Storage Read API does: the schema message on its own, and
+// a message per record batch. The schema message has no body, it is the length prefix and the metadata.
+func serializeArrow(t *testing.T, schema *arrow.Schema, records ...arrow.Record) ([]byte, [][]byte) {
+	var buf bytes.Buffer
+	w := ipc.NewWriter(&buf, ipc.WithSchema(schema))
+	lengths := []int{}
+	for _, record := range records {
+		before := buf.Len()
+		require.NoError(t, w.Write(record))
+		lengths = append(lengths, buf.Len()-before)
+	}
+
+	stream := buf.Bytes()
+	schemaLength := 8 + int(binary.LittleEndian.Uint32(stream[4:8]))
+	serializedSchema := stream[:schemaLength]
+	batches := [][]byte{}
+	offset := schemaLength
+	for n, length := range lengths {
+		if n == 0 {
+			length -= schemaLength
+		}
+		batches = append(batches, stream[offset:offset+length])
+		offset += length
+	}
+	return serializedSchema, batches
+}
+
+func newStorageRecord(ids []int64, names []string, valid []bool, timestamps []time.Time) (*arrow.Schema, arrow.Record) {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "id", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "name", Type: arrow.BinaryTypes.String, Nullable: true},
+		{Name: "ts", Type: &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}},
+	}, nil)
+
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+	builder.Field(0).(*array.Int64Builder).AppendValues(ids, nil)
+	builder.Field(1).(*array.StringBuilder).AppendValues(names, valid)
+	for _, ts := range timestamps {
+		builder.Field(2).(*array.TimestampBuilder).Append(arrow.Timestamp(ts.UnixMicro()))
+	}
+	return schema, builder.NewRecord()
+}
+
+func storageQueryJob() *fakeQueryJob {
+	return &fakeQueryJob{
+		fields: []map[string]interface{}{
+			{"name": "id", "type": "INTEGER", "mode": "REQUIRED"},
+			{"name": "name", "type": "STRING"},
+			{"name": "ts", "type": "TIMESTAMP", "mode": "REQUIRED"},
+		},
+		pages: [][]map[string]interface{}{
+			fakeRows([]interface{}{"1", "a", "1700000000000000"}, []interface{}{"2", nil, "1700000060000000"}),
+			fakeRows([]interface{}{"3", "c", "1700000120000000"}),
+		},
+		destinationTable: map[string]interface{}{"projectId": "test-project", "datasetId": "_anon", "tableId": "anon_result"},
+	}
+}
+
+func Test_readStorage(t *testing.T) {
+	ts := time.Unix(1700000000, 0).UTC()
+	schema, first := newStorageRecord([]int64{1, 2}, []string{"a", ""}, []bool{true, false}, []time.Time{ts, ts.Add(time.Minute)})
+	_, second := newStorageRecord([]int64{3}, []string{"c"}, nil, []time.Time{ts.Add(2 * time.Minute)})
+	serializedSchema, batches := serializeArrow(t, schema, first)
+	_, secondBatches := serializeArrow(t, schema, second)
+	readClient := &fakeReadClient{schema: serializedSchema, batches: append(batches, secondBatches...)}
+
+	t.Run("results over the row threshold are read from the Arrow streams", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, storageQueryJob())
+
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{StorageReadRows: 3}, client)
+		require.NoError(t, err)
+		conn.readClient = readClient
+		readClient.sessions = nil
+
+		ctx, frames := WithFrames(context.Background())
+		res, err := conn.QueryContext(ctx, "SELECT id, name, ts FROM t", nil)
+		require.NoError(t, err)
+		assert.Equal(t, io.EOF, res.Next(make([]driver.Value, 3)), "rows read with the Storage Read API must not be returned again")
+
+		require.Len(t, readClient.sessions, 1)
+		assert.Equal(t, "projects/test-project", readClient.sessions[0].Parent)
+		assert.Equal(t, "projects/test-project/datasets/_anon/tables/anon_result", readClient.sessions[0].ReadSession.Table)
+		assert.Equal(t, storagepb.DataFormat_ARROW, readClient.sessions[0].ReadSession.DataFormat)
+
+		frame := frames.For("SELECT id, name, ts FROM t")
+		require.NotNil(t, frame)
+		require.Equal(t, 3, frame.Rows())
+		assert.Equal(t, "id", frame.Fields[0].Name)
+		assert.Equal(t, int64(3), frame.Fields[0].At(2))
+		assert.Equal(t, "a", *frame.Fields[1].At(0).(*string))
+		assert.Nil(t, frame.Fields[1].At(1))
+		assert.Equal(t, ts.Add(time.Minute), frame.Fields[2].At(1))
+	})
+
+	t.Run("results are read from the Arrow streams up to the row limit", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, storageQueryJob())
+
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{StorageReadRows: 3, RowLimit: 2}, client)
+		require.NoError(t, err)
+		conn.readClient = readClient
+
+		ctx, frames := WithFrames(context.Background())
+		ctx, notices := WithNotices(ctx)
+		_, err = conn.QueryContext(ctx, "SELECT id, name, ts FROM t", nil)
+		require.NoError(t, err)
+
+		frame := frames.For("SELECT id, name, ts FROM t")
+		require.NotNil(t, frame)
+		assert.Equal(t, 2, frame.Rows())
+		require.Len(t, notices.For("SELECT id, name, ts FROM t"), 1)
+		assert.Contains(t, notices.For("SELECT id, name, ts FROM t")[0].Text, "limited to 2 rows")
+	})
+
+	t.Run("results under the thresholds are read through the rows", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, storageQueryJob())
+
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{StorageReadRows: 4}, client)
+		require.NoError(t, err)
+		conn.readClient = readClient
+		readClient.sessions = nil
+
+		ctx, frames := WithFrames(context.Background())
+		res, err := conn.QueryContext(ctx, "SELECT id, name, ts FROM t", nil)
+		require.NoError(t, err)
+		require.NoError(t, res.Next(make([]driver.Value, 3)))
+		assert.Empty(t, readClient.sessions)
+		assert.Nil(t, frames.For("SELECT id, name, ts FROM t"))
+	})
+
+	t.Run("results with arrays unnested into columns are read through the rows", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, &fakeQueryJob{
+			fields: []map[string]interface{}{
+				{"name": "id", "type": "INTEGER", "mode": "REQUIRED"},
+				{"name": "values", "type": "INTEGER", "mode": "REPEATED"},
+			},
+			pages: [][]map[string]interface{}{
+				fakeRows([]interface{}{"1", []interface{}{map[string]interface{}{"v": "10"}}}, []interface{}{"2", []interface{}{}}),
+			},
+			destinationTable: map[string]interface{}{"projectId": "test-project", "datasetId": "_anon", "tableId": "anon_result"},
+		})
+
+		conn, err := NewConn(context.Background(), types.ConnectionSettings{StorageReadRows: 1, UnnestArrays: types.UnnestColumns}, client)
+		require.NoError(t, err)
+		conn.readClient = readClient
+		readClient.sessions = nil
+
+		ctx, frames := WithFrames(context.Background())
+		res, err := conn.QueryContext(ctx, "SELECT id, values FROM t", nil)
+		require.NoError(t, err)
+		dest := make([]driver.Value, 2)
+		require.NoError(t, res.Next(dest))
+		assert.Equal(t, []driver.Value{int64(1), int64(10)}, dest)
+		assert.Empty(t, readClient.sessions)
+		assert.Nil(t, frames.For("SELECT id, values FROM t"))
+	})
+
+	t.Run("falls back to the rows without the readsessions permissions", func(t *testing.T) {
+		fake, client := newFakeBigQuery(t)
+		fake.handleQueryJob(t, storageQueryJob())
+
+		denied := &fakeReadClient{err: grpcstatus.Error(codes.PermissionDenied, "bigquery.readsessions.create denied")}
+		connector := NewConnector(types.ConnectionSettings{StorageReadRows: 1}, client, denied)
+
+		ctx, frames := WithFrames(context.Background())
+		for i := 0; i < 2; i++ {
+			// each query runs on a new connection of the pool
+			conn, err := connector.Connect(context.Background())
+			require.NoError(t, err)
+			res, err := conn.(*Conn).QueryContext(ctx, "SELECT id, name, ts FROM t", nil)
+			require.NoError(t, err)
+			dest := make([]driver.Value, 3)
+			require.NoError(t, res.Next(dest))
+			assert.Equal(t, int64(1), dest[0])
+		}
+		assert.Len(t, denied.sessions, 1, "a denied read session must not be requested again")
+		assert.Nil(t, frames.For("SELECT id, name, ts FROM t"))
+	})
+}
+
+func Test_arrowValue(t *testing.T) {
+	builder := array.NewDecimal128Builder(memory.DefaultAllocator, &arrow.Decimal128Type{Precision: 38, Scale: 9})
+	defer builder.Release()
+	builder.AppendNull()
+	builder.Append(decimal128.FromI64(1500000000))
+	column := builder.NewArray()
+	defer column.Release()
+
+	v, err := arrowValue(column, 0)
+	require.NoError(t, err)
+	assert.Nil(t, v)
+
+	v, err = arrowValue(column, 1)
+	require.NoError(t, err)
+	assert.Equal(t, big.NewRat(3, 2), v)
+}
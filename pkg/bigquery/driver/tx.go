@@ -1,24 +1,134 @@
 package driver
 
-import "github.com/grafana/grafana-plugin-sdk-go/backend/log"
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
 
+	"cloud.google.com/go/bigquery"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// txStatementTimeout bounds the statements beginning and ending transactions which aren't run
+// with a request context, so that a stalled job doesn't hold the connection and its session
+var txStatementTimeout = 5 * time.Minute
+
+// tx is a multi-statement transaction running in a BigQuery session.
+// See https://cloud.google.com/bigquery/docs/transactions
 type tx struct {
 	c *Conn
 }
 
-func newTx(c *Conn) (*tx, error) {
+// beginTx creates a BigQuery session and starts a transaction in it. Until the transaction
+// ends, every statement run on the connection is sent with the ID of the session.
+func (c *Conn) beginTx(ctx context.Context) (*tx, error) {
+	if c.session != "" {
+		return nil, errors.New("a transaction is already in progress on this connection")
+	}
+
+	q, err := c.newQuery(ctx, "BEGIN TRANSACTION", nil)
+	if err != nil {
+		return nil, err
+	}
+	q.CreateSession = true
+
+	_, status, err := c.runJob(ctx, q)
+	if err != nil {
+		return nil, jobError(err, q)
+	}
+	if status.Statistics == nil || status.Statistics.SessionInfo == nil {
+		return nil, errors.New("BigQuery did not create a session for the transaction")
+	}
+
+	c.session = status.Statistics.SessionInfo.SessionID
+	c.txErr = nil
 	return &tx{c: c}, nil
 }
 
-// Commit currently just  passes through
-func (t *tx) Commit() (err error) {
-	log.DefaultLogger.Debug("Got tx.Commit")
+// Commit commits the transaction. If a statement of the transaction failed, it is rolled back
+// instead and the error of the failed statement is returned.
+func (t *tx) Commit() error {
+	if t.c.txErr != nil {
+		failed := t.c.txErr
+		if err := t.end("ROLLBACK TRANSACTION"); err != nil {
+			log.DefaultLogger.Warn("Failed to roll back BigQuery transaction", "err", err)
+		}
+		return fmt.Errorf("transaction rolled back, a statement failed: %w", failed)
+	}
 
-	return
+	return t.end("COMMIT TRANSACTION")
 }
 
-// Rollback currently just  passes through
-func (t *tx) Rollback() (err error) {
-	log.DefaultLogger.Debug("Got tx.Rollback")
-	return
+// Rollback rolls back the transaction
+func (t *tx) Rollback() error {
+	failed := t.c.txErr
+	err := t.end("ROLLBACK TRANSACTION")
+	// BigQuery may already have rolled back a transaction with a failed statement
+	if err != nil && failed != nil {
+		log.DefaultLogger.Debug("Failed to roll back BigQuery transaction with a failed statement", "err", err)
+		return nil
+	}
+	return err
+}
+
+// end runs the statement ending the transaction and then terminates its session
+func (t *tx) end(statement string) error {
+	t.c.txErr = nil
+	txErr := t.c.runTxStatement(statement)
+	t.c.txErr = nil
+
+	if err := t.c.runTxStatement("CALL BQ.ABORT_SESSION()"); err != nil {
+		log.DefaultLogger.Warn("Failed to terminate BigQuery session", "session", t.c.session, "err", err)
+	}
+	t.c.session = ""
+	t.c.txErr = nil
+
+	return txErr
+}
+
+// runTxStatement runs a statement of the transaction, bounded by txStatementTimeout
+func (c *Conn) runTxStatement(statement string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), txStatementTimeout)
+	defer cancel()
+
+	q, err := c.newQuery(ctx, statement, nil)
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.runJob(ctx, q); err != nil {
+		return jobError(err, q)
+	}
+	return nil
+}
+
+// sessionProperties sends statements with the session of the transaction in progress
+func (c *Conn) sessionProperties() []*bigquery.ConnectionProperty {
+	if c.session == "" {
+		return nil
+	}
+	return []*bigquery.ConnectionProperty{{Key: "session_id", Value: c.session}}
+}
+
+// Deprecated: Drivers should implement ConnBeginTx instead.
+func (c *Conn) Begin() (driver.Tx, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), txStatementTimeout)
+	defer cancel()
+	return c.beginTx(ctx)
+}
+
+// BeginTx starts a transaction. BigQuery transactions always use snapshot isolation and can't be read-only.
+func (c *Conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	switch sql.IsolationLevel(opts.Isolation) {
+	case sql.LevelDefault, sql.LevelSnapshot:
+	default:
+		return nil, fmt.Errorf("isolation level %s is not supported by BigQuery", sql.IsolationLevel(opts.Isolation))
+	}
+	if opts.ReadOnly {
+		return nil, errors.New("read-only transactions are not supported by BigQuery")
+	}
+
+	return c.beginTx(ctx)
 }
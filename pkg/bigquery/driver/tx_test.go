@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTxFake(t *testing.T, failOn string) (*fakeQueryJob, *Conn) {
+	fake, client := newFakeBigQuery(t)
+	job := &fakeQueryJob{
+		failOn: failOn,
+		statistics: map[string]interface{}{
+			"query":       map[string]interface{}{},
+			"sessionInfo": map[string]interface{}{"sessionId": "session-1"},
+		},
+	}
+	if failOn != "" {
+		job.errorReason = "invalidQuery"
+	}
+	fake.handleQueryJob(t, job)
+
+	conn, err := NewConn(context.Background(), types.ConnectionSettings{}, client)
+	require.NoError(t, err)
+	return job, conn
+}
+
+func sessionOf(query map[string]interface{}) string {
+	properties, _ := query["connectionProperties"].([]interface{})
+	for _, p := range properties {
+		property := p.(map[string]interface{})
+		if property["key"] == "session_id" {
+			return property["value"].(string)
+		}
+	}
+	return ""
+}
+
+func Test_tx(t *testing.T) {
+	t.Run("runs statements in the session of the transaction", func(t *testing.T) {
+		job, conn := newTxFake(t, "")
+
+		tx, err := conn.BeginTx(context.Background(), driver.TxOptions{})
+		require.NoError(t, err)
+		_, err = conn.ExecContext(context.Background(), "UPDATE t SET a = 1 WHERE true", nil)
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+
+		queries := job.queries()
+		require.Len(t, queries, 4)
+		assert.Equal(t, "BEGIN TRANSACTION", queries[0]["query"])
+		assert.Equal(t, true, queries[0]["createSession"])
+		assert.Equal(t, "UPDATE t SET a = 1 WHERE true", queries[1]["query"])
+		assert.Equal(t, "session-1", sessionOf(queries[1]))
+		assert.Equal(t, "COMMIT TRANSACTION", queries[2]["query"])
+		assert.Equal(t, "session-1", sessionOf(queries[2]))
+		assert.Equal(t, "CALL BQ.ABORT_SESSION()", queries[3]["query"])
+
+		// statements after the transaction run outside of the session
+		_, err = conn.ExecContext(context.Background(), "UPDATE t SET a = 2 WHERE true", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "", sessionOf(job.queries()[4]))
+	})
+
+	t.Run("rolls back the transaction", func(t *testing.T) {
+		job, conn := newTxFake(t, "")
+
+		tx, err := conn.Begin()
+		require.NoError(t, err)
+		require.NoError(t, tx.Rollback())
+
+		queries := job.queries()
+		require.Len(t, queries, 3)
+		assert.Equal(t, "ROLLBACK TRANSACTION", queries[1]["query"])
+		assert.Equal(t, "session-1", sessionOf(queries[1]))
+	})
+
+	t.Run("surfaces a failed statement on commit", func(t *testing.T) {
+		job, conn := newTxFake(t, "broken")
+
+		tx, err := conn.BeginTx(context.Background(), driver.TxOptions{})
+		require.NoError(t, err)
+
+		_, err = conn.ExecContext(context.Background(), "UPDATE broken SET a = 1 WHERE true", nil)
+		require.Error(t, err)
+
+		_, err = conn.ExecContext(context.Background(), "UPDATE t SET a = 1 WHERE true", nil)
+		require.ErrorContains(t, err, "has to be rolled back")
+
+		err = tx.Commit()
+		require.ErrorContains(t, err, "transaction rolled back, a statement failed")
+
+		queries := job.queries()
+		require.Len(t, queries, 4)
+		assert.Equal(t, "ROLLBACK TRANSACTION", queries[2]["query"])
+	})
+
+	t.Run("stops waiting for statements ending the transaction", func(t *testing.T) {
+		txStatementTimeout = 50 * time.Millisecond
+		defer func() { txStatementTimeout = 5 * time.Minute }()
+		job, conn := newTxFake(t, "")
+
+		tx, err := conn.Begin()
+		require.NoError(t, err)
+		job.mu.Lock()
+		job.running = true
+		job.mu.Unlock()
+
+		require.ErrorIs(t, tx.Commit(), context.DeadlineExceeded)
+		assert.Equal(t, "", conn.session)
+	})
+
+	t.Run("rejects unsupported isolation levels", func(t *testing.T) {
+		_, conn := newTxFake(t, "")
+
+		_, err := conn.BeginTx(context.Background(), driver.TxOptions{Isolation: driver.IsolationLevel(sql.LevelSerializable)})
+		require.ErrorContains(t, err, "isolation level Serializable is not supported")
+	})
+}
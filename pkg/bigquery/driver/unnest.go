@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
+)
+
+// unnest expands the first repeated scalar column of the result according to the unnest mode.
+// Repeated records are left as they are, they are converted to JSON.
+func (r *rows) unnest(mode string) error {
+	index := -1
+	for i, fieldSchema := range r.fieldSchemas {
+		if fieldSchema.Repeated && fieldSchema.Type != bigquery.RecordFieldType {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+
+	switch mode {
+	case types.UnnestRows:
+		r.unnestIndex = index
+		r.fieldSchemas[index] = elementSchema(r.fieldSchemas[index])
+		return nil
+	case types.UnnestColumns:
+		return r.unnestColumns(index)
+	default:
+		return fmt.Errorf("unknown unnestArrays mode %q, expected %q or %q", mode, types.UnnestRows, types.UnnestColumns)
+	}
+}
+
+// unnestRow expands a row into a row per element of its array column. Rows with an empty array
+// are kept with a NULL element, like a LEFT JOIN UNNEST would.
+func unnestRow(row []bigquery.Value, index int) [][]bigquery.Value {
+	elements, _ := row[index].([]bigquery.Value)
+	if len(elements) == 0 {
+		elements = []bigquery.Value{nil}
+	}
+
+	res := make([][]bigquery.Value, len(elements))
+	for i, element := range elements {
+		expanded := make([]bigquery.Value, len(row))
+		copy(expanded, row)
+		expanded[index] = element
+		res[i] = expanded
+	}
+	return res
+}
+
+// unnestColumns replaces the array column with a column per index, named after the array column
+// and the index. The number of columns is only known once every row has been read, so the whole
+// result is read up front, up to the row limit. Shorter arrays are padded with NULLs.
+func (r *rows) unnestColumns(index int) error {
+	var buffered [][]bigquery.Value
+	width := 1
+	for {
+		row, err := r.nextRow()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if rowLimit := r.conn.cfg.RowLimit; rowLimit > 0 && int64(len(buffered)) >= rowLimit {
+			return fmt.Errorf("the result has more than %d rows, the row limit of unnesting arrays into columns, "+
+				"unnest them into rows or return fewer rows", rowLimit)
+		}
+		if elements, _ := row[index].([]bigquery.Value); len(elements) > width {
+			width = len(elements)
+		}
+		buffered = append(buffered, row)
+	}
+
+	element := elementSchema(r.fieldSchemas[index])
+	columns := make([]string, width)
+	fieldSchemas := make([]*bigquery.FieldSchema, width)
+	columnTypes := make([]string, width)
+	for i := range columns {
+		columns[i] = fmt.Sprintf("%s[%d]", r.columns[index], i)
+		fieldSchemas[i] = element
+		columnTypes[i] = r.types[index]
+	}
+	r.columns = splice(r.columns, index, columns)
+	r.fieldSchemas = splice(r.fieldSchemas, index, fieldSchemas)
+	r.types = splice(r.types, index, columnTypes)
+
+	for n, row := range buffered {
+		elements, _ := row[index].([]bigquery.Value)
+		padded := make([]bigquery.Value, width)
+		copy(padded, elements)
+		buffered[n] = splice(row, index, padded)
+	}
+	r.expanded = buffered
+	r.unnestedColumns = true
+	return nil
+}
+
+// splice returns a copy of values with the value at index replaced by replacements
+func splice[T any](values []T, index int, replacements []T) []T {
+	res := make([]T, 0, len(values)+len(replacements)-1)
+	res = append(res, values[:index]...)
+	res = append(res, replacements...)
+	return append(res, values[index+1:]...)
+}
@@ -3,22 +3,68 @@ package driver
 import (
 	"database/sql/driver"
 	b64 "encoding/base64"
+	"encoding/json"
 	"fmt"
+	"math"
 	"math/big"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/civil"
 )
 
+// BigQuery NUMERIC values have a precision of 38 digits and a scale of 9 digits, BIGNUMERIC values
+// a precision of 76 digits and a scale of 38 digits, unless the column is parameterized with a
+// precision and scale of its own.
+// See https://cloud.google.com/bigquery/docs/reference/standard-sql/data-types#decimal_types
+const (
+	numericPrecision    = 38
+	numericScale        = 9
+	bigNumericPrecision = 76
+	bigNumericScale     = 38
+)
+
+// ValueConverter converts bigquery.Values to driver.Values
+type ValueConverter struct {
+	// LosslessNumeric converts NUMERIC and BIGNUMERIC values to decimal strings rather than float64
+	LosslessNumeric bool
+	// Location is the time zone of DATE and DATETIME values, UTC if nil
+	Location *time.Location
+	// GeoJSON converts GEOGRAPHY values from WKT to GeoJSON
+	GeoJSON bool
+	// nested is set when converting the elements of arrays and records, which are JSON encoded.
+	// Civil dates and times are kept as strings there.
+	nested bool
+	// precisionLost is called with the field of a NUMERIC or BIGNUMERIC value that a float64 can't represent exactly
+	precisionLost func(fieldSchema *bigquery.FieldSchema)
+	// invalidGeography is called with the field of a GEOGRAPHY value that isn't valid WKT
+	invalidGeography func(fieldSchema *bigquery.FieldSchema, err error)
+}
+
 // Converts an arbitrary bigquery.Value to a driver.Value
 func ConvertColumnValue(v bigquery.Value, fieldSchema *bigquery.FieldSchema) (driver.Value, error) {
+	return ValueConverter{}.ConvertColumnValue(v, fieldSchema)
+}
+
+func ConvertArrayValue(v []bigquery.Value, fieldSchema *bigquery.FieldSchema) (string, error) {
+	return ValueConverter{}.ConvertArrayValue(v, fieldSchema)
+}
+
+// Converts RECORD field to a map or array of maps (for repeated records)
+func ConvertRecordValue(v []bigquery.Value, schema *bigquery.FieldSchema) (driver.Value, error) {
+	return ValueConverter{}.ConvertRecordValue(v, schema)
+}
+
+// Converts an arbitrary bigquery.Value to a driver.Value
+func (c ValueConverter) ConvertColumnValue(v bigquery.Value, fieldSchema *bigquery.FieldSchema) (driver.Value, error) {
 	if v == nil {
 		return nil, nil
 	}
 
 	if fieldSchema.Type == "RECORD" {
-		res, err := ConvertRecordValue(v.([]bigquery.Value), fieldSchema)
+		res, err := c.ConvertRecordValue(v.([]bigquery.Value), fieldSchema)
 		if err != nil {
 			return nil, err
 		}
@@ -26,7 +72,7 @@ func ConvertColumnValue(v bigquery.Value, fieldSchema *bigquery.FieldSchema) (dr
 	}
 
 	if fieldSchema.Repeated {
-		res, err := ConvertArrayValue(v.([]bigquery.Value), fieldSchema)
+		res, err := c.ConvertArrayValue(v.([]bigquery.Value), fieldSchema)
 		if err != nil {
 			return nil, err
 		}
@@ -47,32 +93,180 @@ func ConvertColumnValue(v bigquery.Value, fieldSchema *bigquery.FieldSchema) (dr
 	case "BOOLEAN":
 		return v.(bool), nil
 	case "TIME":
-		return bigquery.CivilTimeString(v.(civil.Time)), nil
+		res := v.(civil.Time)
+		if c.nested {
+			return bigquery.CivilTimeString(res), nil
+		}
+		return sinceMidnight(res), nil
 	case "DATE":
 		res := v.(civil.Date)
 		if !res.IsValid() {
 			return nil, nil
 		}
-		return res.String(), nil
+		if c.nested {
+			return res.String(), nil
+		}
+		return res.In(c.location()), nil
 
 	case "DATETIME":
-		return bigquery.CivilDateTimeString(v.(civil.DateTime)), nil
+		res := v.(civil.DateTime)
+		if c.nested {
+			return bigquery.CivilDateTimeString(res), nil
+		}
+		return res.In(c.location()), nil
 
 	case "NUMERIC", "BIGNUMERIC":
-		conv, _ := v.(*big.Rat).Float64()
-		return conv, nil
+		return c.convertNumericValue(v.(*big.Rat), fieldSchema), nil
 	case "GEOGRAPHY":
+		g, parsed := v.(parsedGeography)
+		if !parsed {
+			if !c.GeoJSON || c.nested {
+				return v.(string), nil
+			}
+			g = parseGeography(v.(string))
+		}
+		res, err := g.geoJSON()
+		if err != nil {
+			// A malformed geometry must not fail the whole query
+			if c.invalidGeography != nil {
+				c.invalidGeography(fieldSchema, err)
+			}
+			return nil, nil
+		}
+		return res, nil
+	case "JSON":
 		return v.(string), nil
+	case "INTERVAL":
+		return v.(*bigquery.IntervalValue).Canonicalize().String(), nil
+	case "RANGE":
+		return rangeString(v.(*bigquery.RangeValue)), nil
 	default:
 		return v, nil
 	}
 }
 
-func ConvertArrayValue(v []bigquery.Value, fieldSchema *bigquery.FieldSchema) (string, error) {
-	res := make([]string, len(v))
+func (c ValueConverter) location() *time.Location {
+	if c.Location == nil {
+		return time.UTC
+	}
+	return c.Location
+}
+
+// sinceMidnight converts a TIME value to the duration since midnight
+func sinceMidnight(t civil.Time) time.Duration {
+	return time.Duration(t.Hour)*time.Hour +
+		time.Duration(t.Minute)*time.Minute +
+		time.Duration(t.Second)*time.Second +
+		time.Duration(t.Nanosecond)
+}
+
+// convertNumericValue converts a NUMERIC or BIGNUMERIC value to a decimal string in lossless mode,
+// and to a float64 otherwise, reporting values which can't be represented exactly as a float64
+func (c ValueConverter) convertNumericValue(v *big.Rat, fieldSchema *bigquery.FieldSchema) driver.Value {
+	if c.LosslessNumeric {
+		return decimalString(v, fieldSchema)
+	}
+
+	conv, exact := v.Float64()
+	if !exact && c.precisionLost != nil && !roundTrips(conv, v) {
+		c.precisionLost(fieldSchema)
+	}
+	return conv
+}
+
+// decimalString formats a decimal value with the scale of its column, without trailing zeros
+func decimalString(v *big.Rat, fieldSchema *bigquery.FieldSchema) string {
+	scale := int(fieldSchema.Scale)
+	if scale <= 0 {
+		scale = numericScale
+		if fieldSchema.Type == "BIGNUMERIC" {
+			scale = bigNumericScale
+		}
+	}
+
+	res := v.FloatString(scale)
+	if strings.Contains(res, ".") {
+		res = strings.TrimRight(strings.TrimRight(res, "0"), ".")
+	}
+	return res
+}
 
-	// A new field schema with the repeated flag set to false. This is needed for the conversion of the values not to consider values as nested repeats.
-	schema := &bigquery.FieldSchema{
+// roundTrips tells whether the shortest decimal representation of a float64 is the decimal value
+// it was converted from. Decimals such as 0.1 are never exact in binary, but are displayed as is.
+func roundTrips(f float64, v *big.Rat) bool {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	return ok && r.Cmp(v) == 0
+}
+
+// rangeString is the canonical form of a range, as BigQuery formats it: [start, end) with UNBOUNDED
+// for a missing start or end
+func rangeString(rv *bigquery.RangeValue) string {
+	return fmt.Sprintf("[%s, %s)", rangeBoundString(rv.Start), rangeBoundString(rv.End))
+}
+
+func rangeBoundString(v bigquery.Value) string {
+	switch bound := v.(type) {
+	case nil:
+		return "UNBOUNDED"
+	case civil.DateTime:
+		return bigquery.CivilDateTimeString(bound)
+	case time.Time:
+		return bound.UTC().Format("2006-01-02 15:04:05.999999 UTC")
+	default:
+		return fmt.Sprint(bound)
+	}
+}
+
+// intervalSeconds is the length of an interval in seconds, with months of 30 days as in
+// IntervalValue.ToDuration. It is computed as a float64, as intervals can be longer than
+// a time.Duration can hold.
+func intervalSeconds(iv *bigquery.IntervalValue) float64 {
+	days := (int64(iv.Years)*12+int64(iv.Months))*30 + int64(iv.Days)
+	seconds := days*24*60*60 + int64(iv.Hours)*60*60 + int64(iv.Minutes)*60 + int64(iv.Seconds)
+	return float64(seconds) + float64(iv.SubSecondNanos)/1e9
+}
+
+// ConvertArrayValue converts a repeated field to a JSON array of its converted elements
+func (c ValueConverter) ConvertArrayValue(v []bigquery.Value, fieldSchema *bigquery.FieldSchema) (string, error) {
+	res, err := c.convertArrayElements(v, fieldSchema)
+	if err != nil {
+		return "", err
+	}
+
+	json, err := json.Marshal(res)
+	if err != nil {
+		return "", err
+	}
+	return string(json), nil
+}
+
+// convertArrayElements converts the elements of a repeated field, keeping their types
+func (c ValueConverter) convertArrayElements(v []bigquery.Value, fieldSchema *bigquery.FieldSchema) ([]interface{}, error) {
+	res := make([]interface{}, len(v))
+	schema := elementSchema(fieldSchema)
+	c.nested = true
+
+	for i, val := range v {
+		converted, err := c.ConvertColumnValue(val, schema)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// JSON has no representation for NaN and infinities, they are kept as BigQuery formats them
+		if f, ok := converted.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			converted = strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		res[i] = converted
+	}
+
+	return res, nil
+}
+
+// elementSchema is the schema of the elements of a repeated field. The repeated flag is not set,
+// so that the elements aren't converted as nested repeats.
+func elementSchema(fieldSchema *bigquery.FieldSchema) *bigquery.FieldSchema {
+	return &bigquery.FieldSchema{
 		Description: fieldSchema.Description,
 		Name:        fieldSchema.Name,
 		Repeated:    false,
@@ -83,22 +277,11 @@ func ConvertArrayValue(v []bigquery.Value, fieldSchema *bigquery.FieldSchema) (s
 		Precision:   fieldSchema.Precision,
 		Scale:       fieldSchema.Scale,
 	}
-
-	for i, val := range v {
-		converted, err := ConvertColumnValue(val, schema)
-
-		if err != nil {
-			return "", err
-		}
-
-		res[i] = fmt.Sprintf("%v", converted)
-	}
-
-	return strings.Join(res, ","), nil
 }
 
 // Converts RECORD field to a map or array of maps (for repeated records)
-func ConvertRecordValue(v []bigquery.Value, schema *bigquery.FieldSchema) (driver.Value, error) {
+func (c ValueConverter) ConvertRecordValue(v []bigquery.Value, schema *bigquery.FieldSchema) (driver.Value, error) {
+	c.nested = true
 	if schema.Repeated {
 		res := make([]interface{}, len(v))
 
@@ -111,7 +294,7 @@ func ConvertRecordValue(v []bigquery.Value, schema *bigquery.FieldSchema) (drive
 				}
 
 				fs := bigquery.FieldSchema{Schema: schema.Schema}
-				record, err := ConvertRecordValue((val.([]bigquery.Value)), &fs)
+				record, err := c.ConvertRecordValue((val.([]bigquery.Value)), &fs)
 
 				if err != nil {
 					return "", err
@@ -129,8 +312,15 @@ func ConvertRecordValue(v []bigquery.Value, schema *bigquery.FieldSchema) (drive
 	for i, field := range schema.Schema {
 		if v[i] == nil {
 			res[field.Name] = nil
+		} else if field.Repeated && field.Type != "RECORD" {
+			// Arrays nested in records are kept as arrays rather than as JSON strings
+			elements, err := c.convertArrayElements(v[i].([]bigquery.Value), field)
+			if err != nil {
+				return "", err
+			}
+			res[field.Name] = elements
 		} else {
-			record, err := ConvertColumnValue(v[i], field)
+			record, err := c.ConvertColumnValue(v[i], field)
 
 			if err != nil {
 				return "", err
@@ -1,10 +1,13 @@
 package driver
 
 import (
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"math"
 	"math/big"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/civil"
@@ -38,7 +41,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "TINYINT",
 			schema:        &bigquery.FieldSchema{Type: "TINYINT", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "1,2",
+			expectedValue: "[1,2]",
 		},
 		{
 			name:          "numeric type SMALLINT",
@@ -54,7 +57,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "TINYINT",
 			schema:        &bigquery.FieldSchema{Type: "SMALLINT", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "1,2",
+			expectedValue: "[1,2]",
 		},
 		{
 			name:          "numeric type INT",
@@ -70,7 +73,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "INT",
 			schema:        &bigquery.FieldSchema{Type: "INT", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "1,2",
+			expectedValue: "[1,2]",
 		},
 		{
 			name:          "numeric type INTEGER",
@@ -86,7 +89,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "INTEGER",
 			schema:        &bigquery.FieldSchema{Type: "INTEGER", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "1,2",
+			expectedValue: "[1,2]",
 		},
 		{
 			name:          "numeric type INT64",
@@ -102,7 +105,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "INT64",
 			schema:        &bigquery.FieldSchema{Type: "INT64", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "1,2",
+			expectedValue: "[1,2]",
 		},
 		{
 			name:          "numeric type FLOAT",
@@ -118,7 +121,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "FLOAT",
 			schema:        &bigquery.FieldSchema{Type: "FLOAT", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "1.99999,2.99999",
+			expectedValue: "[1.99999,2.99999]",
 		},
 		{
 			name:          "numeric type FLOAT64",
@@ -134,7 +137,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "FLOAT64",
 			schema:        &bigquery.FieldSchema{Type: "FLOAT64", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "1.99999,2.99999",
+			expectedValue: "[1.99999,2.99999]",
 		},
 		{
 			name:          "numeric type NUMERIC",
@@ -150,7 +153,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "NUMERIC",
 			schema:        &bigquery.FieldSchema{Type: "NUMERIC", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "2,3",
+			expectedValue: "[2,3]",
 		},
 		{
 			name:          "numeric type BIGNUMERIC",
@@ -166,7 +169,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "BIGNUMERIC",
 			schema:        &bigquery.FieldSchema{Type: "BIGNUMERIC", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "2.34e+12,3.34e+12",
+			expectedValue: "[2340000000000,3340000000000]",
 		},
 		{
 			name:          "numeric type NUMERIC",
@@ -182,7 +185,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "NUMERIC",
 			schema:        &bigquery.FieldSchema{Type: "NUMERIC", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "1.99999,2.99999",
+			expectedValue: "[1.99999,2.99999]",
 		},
 		{
 			name:          "numeric type NUMERIC",
@@ -198,15 +201,15 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "NUMERIC",
 			schema:        &bigquery.FieldSchema{Type: "NUMERIC", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "11.111111111,11.111111111",
+			expectedValue: "[11.111111111,11.111111111]",
 		},
 		{
 			name:          "DATE",
 			value:         bigquery.Value(civil.Date{Year: 2019, Month: 1, Day: 1}),
 			columnType:    "DATE",
 			schema:        &bigquery.FieldSchema{Type: "DATE"},
-			expectedType:  "string",
-			expectedValue: "2019-01-01",
+			expectedType:  "time.Time",
+			expectedValue: "2019-01-01 00:00:00 +0000 UTC",
 		},
 		{
 			name:          "DATE repeated",
@@ -214,15 +217,15 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "DATE",
 			schema:        &bigquery.FieldSchema{Type: "DATE", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "2019-01-01,2019-02-01",
+			expectedValue: `["2019-01-01","2019-02-01"]`,
 		},
 		{
 			name:          "DATETIME",
 			value:         bigquery.Value(civil.DateTime{Date: civil.Date{Year: 2019, Month: 1, Day: 1}, Time: civil.Time{Hour: 1, Minute: 1, Second: 1}}),
 			columnType:    "DATETIME",
 			schema:        &bigquery.FieldSchema{Type: "DATETIME"},
-			expectedType:  "string",
-			expectedValue: "2019-01-01 01:01:01",
+			expectedType:  "time.Time",
+			expectedValue: "2019-01-01 01:01:01 +0000 UTC",
 		},
 		{
 			name: "DATETIME repeated",
@@ -233,15 +236,15 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "DATETIME",
 			schema:        &bigquery.FieldSchema{Type: "DATETIME", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "2019-01-01 01:01:01,2019-02-01 01:01:01",
+			expectedValue: `["2019-01-01 01:01:01","2019-02-01 01:01:01"]`,
 		},
 		{
 			name:          "TIME",
 			value:         bigquery.Value(civil.Time{Hour: 1, Minute: 1, Second: 1}),
 			columnType:    "TIME",
 			schema:        &bigquery.FieldSchema{Type: "TIME"},
-			expectedType:  "string",
-			expectedValue: "01:01:01",
+			expectedType:  "time.Duration",
+			expectedValue: "1h1m1s",
 		},
 		{
 			name:          "TIME repeated",
@@ -249,7 +252,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "TIME",
 			schema:        &bigquery.FieldSchema{Type: "TIME", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "01:01:01,02:01:01",
+			expectedValue: `["01:01:01","02:01:01"]`,
 		},
 		{
 			name:          "GEOGRAPHY",
@@ -265,7 +268,7 @@ func Test_ConvertColumnValue(t *testing.T) {
 			columnType:    "GEOGRAPHY",
 			schema:        &bigquery.FieldSchema{Type: "GEOGRAPHY", Repeated: true},
 			expectedType:  "string",
-			expectedValue: "POINT(1.0 1.0),POINT(2.0 2.0)",
+			expectedValue: `["POINT(1.0 1.0)","POINT(2.0 2.0)"]`,
 		},
 		{
 			name: "RECORD",
@@ -365,6 +368,55 @@ func Test_ConvertColumnValue(t *testing.T) {
 			expectedType:  "[]interface {}",
 			expectedValue: "[null,{\"col1\":2,\"col2\":2.99999,\"col3\":\"text value 2\",\"col4\":\"02:02:02\",\"col5\":\"2019-02-02 01:01:01\"}]",
 		},
+		{
+			name:          "JSON",
+			value:         bigquery.Value(`{"a":[1,2]}`),
+			columnType:    "JSON",
+			schema:        &bigquery.FieldSchema{Type: "JSON"},
+			expectedType:  "string",
+			expectedValue: `{"a":[1,2]}`,
+		},
+		{
+			name:          "INTERVAL",
+			value:         bigquery.Value(&bigquery.IntervalValue{Months: 14, Days: 3, Minutes: 90, SubSecondNanos: 500000000}),
+			columnType:    "INTERVAL",
+			schema:        &bigquery.FieldSchema{Type: "INTERVAL"},
+			expectedType:  "string",
+			expectedValue: "1-2 3 1:30:0.5",
+		},
+		{
+			name:          "STRING repeated with commas",
+			value:         bigquery.Value([]bigquery.Value{"a,b", "c"}),
+			columnType:    "STRING",
+			schema:        &bigquery.FieldSchema{Type: "STRING", Repeated: true},
+			expectedType:  "string",
+			expectedValue: `["a,b","c"]`,
+		},
+		{
+			name:          "FLOAT64 repeated with NaN",
+			value:         bigquery.Value([]bigquery.Value{float64(1.5), math.NaN(), math.Inf(-1)}),
+			columnType:    "FLOAT64",
+			schema:        &bigquery.FieldSchema{Type: "FLOAT64", Repeated: true},
+			expectedType:  "string",
+			expectedValue: `[1.5,"NaN","-Inf"]`,
+		},
+		{
+			name: "RECORD with repeated field",
+			value: bigquery.Value([]bigquery.Value{
+				bigquery.Value("name"),
+				bigquery.Value([]bigquery.Value{int64(1), int64(2)}),
+			}),
+			columnType: "RECORD",
+			schema: &bigquery.FieldSchema{
+				Type: "RECORD",
+				Schema: bigquery.Schema{
+					{Name: "col1", Type: "STRING"},
+					{Name: "col2", Type: "INTEGER", Repeated: true},
+				},
+			},
+			expectedType:  "map[string]interface {}",
+			expectedValue: `{"col1":"name","col2":[1,2]}`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -384,3 +436,101 @@ func Test_ConvertColumnValue(t *testing.T) {
 		})
 	}
 }
+
+func TestValueConverter_LosslessNumeric(t *testing.T) {
+	converter := ValueConverter{LosslessNumeric: true}
+
+	tests := []struct {
+		name          string
+		value         bigquery.Value
+		schema        *bigquery.FieldSchema
+		expectedValue driver.Value
+	}{
+		{
+			name:          "NUMERIC",
+			value:         big.NewRat(1, 10),
+			schema:        &bigquery.FieldSchema{Type: "NUMERIC"},
+			expectedValue: "0.1",
+		},
+		{
+			name:          "NUMERIC integer",
+			value:         big.NewRat(42, 1),
+			schema:        &bigquery.FieldSchema{Type: "NUMERIC"},
+			expectedValue: "42",
+		},
+		{
+			name:          "NUMERIC with scale",
+			value:         big.NewRat(1, 3),
+			schema:        &bigquery.FieldSchema{Type: "NUMERIC", Precision: 5, Scale: 2},
+			expectedValue: "0.33",
+		},
+		{
+			name:          "BIGNUMERIC beyond float64 precision",
+			value:         bigRat(t, "12345678901234567890.123456789012345678"),
+			schema:        &bigquery.FieldSchema{Type: "BIGNUMERIC"},
+			expectedValue: "12345678901234567890.123456789012345678",
+		},
+		{
+			name:          "NUMERIC repeated",
+			value:         []bigquery.Value{big.NewRat(1, 10), big.NewRat(-5, 2)},
+			schema:        &bigquery.FieldSchema{Type: "NUMERIC", Repeated: true},
+			expectedValue: `["0.1","-2.5"]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := converter.ConvertColumnValue(tt.value, tt.schema)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedValue, v)
+		})
+	}
+}
+
+func TestValueConverter_precisionLost(t *testing.T) {
+	var lost []string
+	converter := ValueConverter{precisionLost: func(fieldSchema *bigquery.FieldSchema) {
+		lost = append(lost, fieldSchema.Name)
+	}}
+
+	v, err := converter.ConvertColumnValue(big.NewRat(1, 10), &bigquery.FieldSchema{Name: "exact", Type: "NUMERIC"})
+	require.NoError(t, err)
+	assert.Equal(t, 0.1, v)
+
+	v, err = converter.ConvertColumnValue(bigRat(t, "12345678901234567890.123456789"), &bigquery.FieldSchema{Name: "rounded", Type: "BIGNUMERIC"})
+	require.NoError(t, err)
+	assert.Equal(t, 12345678901234567890.123456789, v)
+
+	assert.Equal(t, []string{"rounded"}, lost)
+}
+
+func bigRat(t *testing.T, s string) *big.Rat {
+	t.Helper()
+	r, ok := new(big.Rat).SetString(s)
+	require.True(t, ok)
+	return r
+}
+
+func Test_intervalSeconds(t *testing.T) {
+	assert.Equal(t, 5400.5, intervalSeconds(&bigquery.IntervalValue{Minutes: 90, SubSecondNanos: 500000000}))
+	assert.Equal(t, float64(-(30*24*60*60 + 1)), intervalSeconds(&bigquery.IntervalValue{Months: -1, Seconds: -1}))
+	assert.Equal(t, float64(10000*12*30*24*60*60), intervalSeconds(&bigquery.IntervalValue{Years: 10000}))
+}
+
+func TestValueConverter_Location(t *testing.T) {
+	location, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+	converter := ValueConverter{Location: location}
+
+	v, err := converter.ConvertColumnValue(civil.Date{Year: 2019, Month: 7, Day: 1}, &bigquery.FieldSchema{Type: "DATE"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2019, 6, 30, 22, 0, 0, 0, time.UTC), v.(time.Time).UTC())
+
+	v, err = converter.ConvertColumnValue(civil.DateTime{Date: civil.Date{Year: 2019, Month: 1, Day: 1}, Time: civil.Time{Hour: 12}}, &bigquery.FieldSchema{Type: "DATETIME"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2019, 1, 1, 11, 0, 0, 0, time.UTC), v.(time.Time).UTC())
+
+	v, err = converter.ConvertColumnValue(civil.Time{Hour: 12, Nanosecond: 500}, &bigquery.FieldSchema{Type: "TIME"})
+	require.NoError(t, err)
+	assert.Equal(t, 12*time.Hour+500*time.Nanosecond, v)
+}
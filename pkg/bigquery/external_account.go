@@ -0,0 +1,127 @@
+package bigquery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// externalAccountType is the type of the credential configuration files of Workload Identity Federation
+const externalAccountType = "external_account"
+
+// googleAPIsDomain is the domain of the global, regional and Private Service Connect endpoints of Google APIs
+const googleAPIsDomain = "googleapis.com"
+
+// stsEndpoint overrides the token URL of external account configurations when set
+var stsEndpoint = ""
+
+// externalAccountConfig is the part of an external account configuration checked before it is used. The
+// configuration is supplied by whoever can edit the data source, its subject tokens must only be sent to
+// Google, and it must not make the server run commands.
+type externalAccountConfig struct {
+	Type                           string `json:"type"`
+	TokenURL                       string `json:"token_url"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	CredentialSource               struct {
+		Executable json.RawMessage `json:"executable"`
+	} `json:"credential_source"`
+}
+
+// isGoogleURL tells whether a URL is an https URL of a Google API endpoint, such as sts.googleapis.com,
+// a regional endpoint or a Private Service Connect endpoint on p.googleapis.com
+func isGoogleURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(u.Hostname()), "."+googleAPIsDomain)
+}
+
+func validateExternalAccountSettings(settings types.BigQuerySettings) error {
+	if settings.DefaultProject == "" || settings.ExternalAccountConfig == "" {
+		return fmt.Errorf("datasource is missing the default project or the external account configuration")
+	}
+
+	var config externalAccountConfig
+	if err := json.Unmarshal([]byte(settings.ExternalAccountConfig), &config); err != nil {
+		return fmt.Errorf("invalid external account configuration: %w", err)
+	}
+	if config.Type != externalAccountType {
+		return fmt.Errorf("invalid external account configuration: type is %q, expected %q", config.Type, externalAccountType)
+	}
+	if !isGoogleURL(config.TokenURL) {
+		return fmt.Errorf("invalid external account configuration: token_url must be an https URL of %s", googleAPIsDomain)
+	}
+	if config.ServiceAccountImpersonationURL != "" && !isGoogleURL(config.ServiceAccountImpersonationURL) {
+		return fmt.Errorf("invalid external account configuration: service_account_impersonation_url must be an https URL of %s", googleAPIsDomain)
+	}
+	if len(config.CredentialSource.Executable) > 0 {
+		return fmt.Errorf("invalid external account configuration: executable credential sources aren't supported")
+	}
+	return nil
+}
+
+// overrideEndpoints points the token and impersonation URLs of a validated configuration to the
+// overridden endpoints, if any
+func overrideEndpoints(rawConfig string) ([]byte, error) {
+	if stsEndpoint == "" && iamCredentialsEndpoint == "" {
+		return []byte(rawConfig), nil
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(rawConfig), &config); err != nil {
+		return nil, err
+	}
+	if stsEndpoint != "" {
+		config["token_url"] = stsEndpoint
+	}
+	if impersonationURL, ok := config["service_account_impersonation_url"].(string); ok && iamCredentialsEndpoint != "" {
+		u, err := url.Parse(impersonationURL)
+		if err != nil {
+			return nil, err
+		}
+		config["service_account_impersonation_url"] = strings.TrimSuffix(iamCredentialsEndpoint, "/") + u.Path
+	}
+	return json.Marshal(config)
+}
+
+// externalAccountTokenSource exchanges the subject tokens of the credential source of the external account
+// configuration, read from a file or fetched from a URL, for Google tokens through the Security Token Service.
+// The service account of the configuration, if any, is impersonated with the exchanged tokens.
+func externalAccountTokenSource(settings types.BigQuerySettings, scopes ...string) (oauth2.TokenSource, error) {
+	config, err := overrideEndpoints(settings.ExternalAccountConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid external account configuration: %w", err)
+	}
+	credentials, err := google.CredentialsFromJSON(context.Background(), config, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid external account configuration: %w", err)
+	}
+	return credentials.TokenSource, nil
+}
+
+// newExternalAccountTokenProvider returns a provider of tokens of the external account of the data source. The
+// service account of the data source, if any, is impersonated with the tokens of the external account.
+func newExternalAccountTokenProvider(settings types.BigQuerySettings, routePath string) (*tokenSourceProvider, error) {
+	if err := validateExternalAccountSettings(settings); err != nil {
+		return nil, err
+	}
+
+	return cachedTokenProvider(settings, routePath, func() (oauth2.TokenSource, error) {
+		if settings.ImpersonateServiceAccount == "" {
+			return externalAccountTokenSource(settings, routes[routePath].scopes...)
+		}
+
+		base, err := externalAccountTokenSource(settings, cloudPlatformScope)
+		if err != nil {
+			return nil, err
+		}
+		return newImpersonatingTokenSource(base, settings, routePath)
+	})
+}
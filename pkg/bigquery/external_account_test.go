@@ -0,0 +1,198 @@
+package bigquery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAudience = "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider"
+
+// newFakeSTS is a local Security Token Service exchanging the given subject token for federated tokens,
+// and impersonating service accounts with those on its /v1/ paths like the IAM Credentials API
+func newFakeSTS(t *testing.T, subjectToken string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if strings.HasSuffix(r.URL.Path, ":generateAccessToken") {
+			assert.Equal(t, "Bearer federated-token", r.Header.Get("Authorization"))
+			name := strings.TrimSuffix(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:], ":generateAccessToken")
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"accessToken": "impersonated-" + name,
+				"expireTime":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			})
+			return
+		}
+
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:token-exchange", r.Form.Get("grant_type"))
+		assert.Equal(t, testAudience, r.Form.Get("audience"))
+		if r.Form.Get("subject_token") != subjectToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":      "federated-token",
+			"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+			"token_type":        "Bearer",
+			"expires_in":        3600,
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testExternalAccountConfig(t *testing.T, config map[string]interface{}) string {
+	t.Helper()
+	config["type"] = externalAccountType
+	config["audience"] = testAudience
+	config["subject_token_type"] = "urn:ietf:params:oauth:token-type:jwt"
+	res, err := json.Marshal(config)
+	require.NoError(t, err)
+	return string(res)
+}
+
+func Test_newExternalAccountTokenProvider(t *testing.T) {
+	sts := newFakeSTS(t, "subject-token")
+	stsEndpoint, iamCredentialsEndpoint = sts.URL+"/token", sts.URL+"/"
+	defer func() { stsEndpoint, iamCredentialsEndpoint = "", "" }()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("subject-token"), 0600))
+
+	settings := func(id int64, config string) types.BigQuerySettings {
+		return types.BigQuerySettings{
+			DatasourceId:          id,
+			Updated:               time.Now(),
+			AuthenticationType:    "externalAccount",
+			DefaultProject:        "raintank-dev",
+			ExternalAccountConfig: config,
+		}
+	}
+
+	t.Run("requires an external_account configuration", func(t *testing.T) {
+		_, err := getTokenProvider(settings(100, `{"type":"service_account"}`), bigQueryRoute)
+		assert.ErrorContains(t, err, `expected "external_account"`)
+	})
+
+	t.Run("only sends subject tokens to Google and doesn't run executables", func(t *testing.T) {
+		for name, config := range map[string]map[string]interface{}{
+			"token URL of another host": {
+				"token_url":         "https://attacker.example.com/token",
+				"credential_source": map[string]interface{}{"file": tokenFile},
+			},
+			"plain http token URL": {
+				"token_url":         "http://sts.googleapis.com/v1/token",
+				"credential_source": map[string]interface{}{"file": tokenFile},
+			},
+			"impersonation URL of another host": {
+				"token_url":                         "https://sts.googleapis.com/v1/token",
+				"service_account_impersonation_url": "https://attacker.example.com/v1/projects/-/serviceAccounts/sa:generateAccessToken",
+				"credential_source":                 map[string]interface{}{"file": tokenFile},
+			},
+			"token URL of a domain ending like Google's": {
+				"token_url":         "https://sts.evilgoogleapis.com/v1/token",
+				"credential_source": map[string]interface{}{"file": tokenFile},
+			},
+			"token URL with Google in its user info": {
+				"token_url":         "https://sts.googleapis.com@attacker.example.com/v1/token",
+				"credential_source": map[string]interface{}{"file": tokenFile},
+			},
+			"executable source": {
+				"token_url":         "https://sts.googleapis.com/v1/token",
+				"credential_source": map[string]interface{}{"executable": map[string]interface{}{"command": "cat /etc/passwd"}},
+			},
+		} {
+			_, err := getTokenProvider(settings(105, testExternalAccountConfig(t, config)), bigQueryRoute)
+			assert.ErrorContains(t, err, "invalid external account configuration", name)
+		}
+	})
+
+	t.Run("exchanges file-sourced subject tokens", func(t *testing.T) {
+		provider, err := getTokenProvider(settings(101, testExternalAccountConfig(t, map[string]interface{}{
+			"token_url":         "https://sts.googleapis.com/v1/token",
+			"credential_source": map[string]interface{}{"file": tokenFile},
+		})), bigQueryRoute)
+		require.NoError(t, err)
+
+		token, err := provider.GetAccessToken(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "federated-token", token)
+	})
+
+	t.Run("accepts regional and Private Service Connect endpoints", func(t *testing.T) {
+		for _, urls := range [][2]string{
+			{"https://sts.us-east1.rep.googleapis.com/v1/token", "https://iamcredentials.us-east1.rep.googleapis.com/v1/projects/-/serviceAccounts/sa:generateAccessToken"},
+			{"https://sts-endpoint.p.googleapis.com/v1/token", "https://iamcredentials-endpoint.p.googleapis.com/v1/projects/-/serviceAccounts/sa:generateAccessToken"},
+		} {
+			_, err := getTokenProvider(settings(106, testExternalAccountConfig(t, map[string]interface{}{
+				"token_url":                         urls[0],
+				"service_account_impersonation_url": urls[1],
+				"credential_source":                 map[string]interface{}{"file": tokenFile},
+			})), bigQueryRoute)
+			assert.NoError(t, err, urls[0])
+		}
+	})
+
+	t.Run("exchanges URL-sourced subject tokens and impersonates the configured service account", func(t *testing.T) {
+		metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "true", r.Header.Get("Metadata"))
+			_, _ = w.Write([]byte(`{"access_token":"subject-token"}`))
+		}))
+		defer metadata.Close()
+
+		provider, err := getTokenProvider(settings(102, testExternalAccountConfig(t, map[string]interface{}{
+			"token_url":                         "https://sts.googleapis.com/v1/token",
+			"service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/config-sa:generateAccessToken",
+			"credential_source": map[string]interface{}{
+				"url":     metadata.URL,
+				"headers": map[string]string{"Metadata": "true"},
+				"format":  map[string]string{"type": "json", "subject_token_field_name": "access_token"},
+			},
+		})), bigQueryRoute)
+		require.NoError(t, err)
+
+		token, err := provider.GetAccessToken(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "impersonated-config-sa", token)
+	})
+
+	t.Run("impersonates the service account of the data source", func(t *testing.T) {
+		s := settings(103, testExternalAccountConfig(t, map[string]interface{}{
+			"token_url":         "https://sts.googleapis.com/v1/token",
+			"credential_source": map[string]interface{}{"file": tokenFile},
+		}))
+		s.ImpersonateServiceAccount = "target@raintank-dev.iam.gserviceaccount.com"
+		provider, err := getTokenProvider(s, bigQueryRoute)
+		require.NoError(t, err)
+
+		token, err := provider.GetAccessToken(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "impersonated-target@raintank-dev.iam.gserviceaccount.com", token)
+	})
+
+	t.Run("fails when the subject token is rejected", func(t *testing.T) {
+		rejectedFile := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(rejectedFile, []byte("other-token"), 0600))
+
+		provider, err := getTokenProvider(settings(104, testExternalAccountConfig(t, map[string]interface{}{
+			"token_url":         "https://sts.googleapis.com/v1/token",
+			"credential_source": map[string]interface{}{"file": rejectedFile},
+		})), bigQueryRoute)
+		require.NoError(t, err)
+
+		_, err = provider.GetAccessToken(context.Background())
+		assert.ErrorContains(t, err, "invalid_grant")
+	})
+}
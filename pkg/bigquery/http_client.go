@@ -1,12 +1,14 @@
 package bigquery
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
 	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
 	"github.com/grafana/grafana-google-sdk-go/pkg/tokenprovider"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"golang.org/x/oauth2"
 )
 
 const (
@@ -39,6 +41,15 @@ var routes = map[string]routeInfo{
 }
 
 func getMiddleware(settings types.BigQuerySettings, routePath string) (httpclient.Middleware, error) {
+	provider, err := getTokenProvider(settings, routePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenprovider.AuthMiddleware(provider), nil
+}
+
+func getTokenProvider(settings types.BigQuerySettings, routePath string) (tokenprovider.TokenProvider, error) {
 	providerConfig := tokenprovider.Config{
 		RoutePath:         routePath,
 		RouteMethod:       routes[routePath].method,
@@ -64,9 +75,44 @@ func getMiddleware(settings types.BigQuerySettings, routePath string) (httpclien
 			PrivateKey: []byte(settings.PrivateKey),
 		}
 		provider = tokenprovider.NewJwtAccessTokenProvider(providerConfig)
+	case "impersonate":
+		impersonatedProvider, err := newImpersonatedTokenProvider(settings, routePath)
+		if err != nil {
+			return nil, err
+		}
+		provider = impersonatedProvider
+	case "externalAccount":
+		externalAccountProvider, err := newExternalAccountTokenProvider(settings, routePath)
+		if err != nil {
+			return nil, err
+		}
+		provider = externalAccountProvider
 	}
 
-	return tokenprovider.AuthMiddleware(provider), nil
+	return provider, nil
+}
+
+// providerTokenSource gets the tokens of gRPC clients, which can't be given an http.Client, from a token provider
+type providerTokenSource struct {
+	provider tokenprovider.TokenProvider
+}
+
+// Token returns a token without an expiry, tokens are cached and refreshed by the provider
+func (s *providerTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.provider.GetAccessToken(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: token, TokenType: "Bearer"}, nil
+}
+
+func newTokenSource(settings types.BigQuerySettings, route string) (oauth2.TokenSource, error) {
+	provider, err := getTokenProvider(settings, route)
+	if err != nil {
+		return nil, err
+	}
+
+	return &providerTokenSource{provider: provider}, nil
 }
 
 func newHTTPClient(settings types.BigQuerySettings, opts httpclient.Options, route string) (*http.Client, error) {
@@ -0,0 +1,159 @@
+package bigquery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+// cloudPlatformScope is the scope of the base credentials, required by the IAM Credentials API
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+var (
+	// iamCredentialsEndpoint overrides the endpoint of the IAM Credentials API when set
+	iamCredentialsEndpoint = ""
+	// tokenSources are kept per data source, settings update and route, so that tokens are reused by the
+	// http clients of a data source until they expire. Those of previous settings are evicted.
+	tokenSources sync.Map
+)
+
+// tokenSourceProvider provides the tokens of a token source to the auth middleware
+type tokenSourceProvider struct {
+	tokenSource oauth2.TokenSource
+}
+
+func (p *tokenSourceProvider) GetAccessToken(_ context.Context) (string, error) {
+	token, err := p.tokenSource.Token()
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// impersonatedTokenSource mints short-lived tokens of the target service account with the IAM
+// Credentials API. Each service account of the delegation chain has to be granted the Service
+// Account Token Creator role on the next one, and the last one on the target service account.
+type impersonatedTokenSource struct {
+	service         *iamcredentials.Service
+	targetPrincipal string
+	delegates       []string
+	scopes          []string
+}
+
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	delegates := make([]string, len(s.delegates))
+	for i, delegate := range s.delegates {
+		delegates[i] = serviceAccountName(delegate)
+	}
+
+	res, err := s.service.Projects.ServiceAccounts.GenerateAccessToken(serviceAccountName(s.targetPrincipal), &iamcredentials.GenerateAccessTokenRequest{
+		Delegates: delegates,
+		Scope:     s.scopes,
+	}).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate service account %s: %w", s.targetPrincipal, err)
+	}
+
+	expiry, err := time.Parse(time.RFC3339, res.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry of the token of service account %s: %w", s.targetPrincipal, err)
+	}
+	return &oauth2.Token{AccessToken: res.AccessToken, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+func serviceAccountName(email string) string {
+	return "projects/-/serviceAccounts/" + email
+}
+
+// baseTokenSource is the token source of the credentials impersonating the service account: the
+// service account key of the data source if one is configured, the GCE service account otherwise
+func baseTokenSource(settings types.BigQuerySettings) oauth2.TokenSource {
+	if settings.ClientEmail != "" && settings.PrivateKey != "" {
+		config := &jwt.Config{
+			Email:      settings.ClientEmail,
+			PrivateKey: []byte(settings.PrivateKey),
+			TokenURL:   settings.TokenUri,
+			Scopes:     []string{cloudPlatformScope},
+		}
+		if config.TokenURL == "" {
+			config.TokenURL = google.JWTTokenURL
+		}
+		return config.TokenSource(context.Background())
+	}
+	return google.ComputeTokenSource("", cloudPlatformScope)
+}
+
+func validateImpersonationSettings(settings types.BigQuerySettings) error {
+	if settings.DefaultProject == "" || settings.ImpersonateServiceAccount == "" {
+		return fmt.Errorf("datasource is missing the default project or the service account to impersonate")
+	}
+	return nil
+}
+
+// evictStaleTokenSources removes the token sources of a data source created before its settings were last updated
+func evictStaleTokenSources(id int64, updated time.Time) {
+	datasourcePrefix := fmt.Sprintf("%d@", id)
+	currentPrefix := fmt.Sprintf("%d@%d/", id, updated.UnixMilli())
+	tokenSources.Range(func(key, _ interface{}) bool {
+		if strings.HasPrefix(key.(string), datasourcePrefix) && !strings.HasPrefix(key.(string), currentPrefix) {
+			tokenSources.Delete(key)
+		}
+		return true
+	})
+}
+
+// cachedTokenProvider returns a provider of the token source of a data source route, created on first use
+func cachedTokenProvider(settings types.BigQuerySettings, routePath string, newTokenSource func() (oauth2.TokenSource, error)) (*tokenSourceProvider, error) {
+	key := fmt.Sprintf("%d@%d/%s", settings.DatasourceId, settings.Updated.UnixMilli(), routePath)
+	if tokenSource, ok := tokenSources.Load(key); ok {
+		return &tokenSourceProvider{tokenSource: tokenSource.(oauth2.TokenSource)}, nil
+	}
+	evictStaleTokenSources(settings.DatasourceId, settings.Updated)
+
+	tokenSource, err := newTokenSource()
+	if err != nil {
+		return nil, err
+	}
+	cached, _ := tokenSources.LoadOrStore(key, tokenSource)
+	return &tokenSourceProvider{tokenSource: cached.(oauth2.TokenSource)}, nil
+}
+
+// newImpersonatingTokenSource returns a token source of the service account impersonated by the data source,
+// whose tokens are minted with the tokens of the base token source
+func newImpersonatingTokenSource(base oauth2.TokenSource, settings types.BigQuerySettings, routePath string) (oauth2.TokenSource, error) {
+	opts := []option.ClientOption{option.WithTokenSource(base)}
+	if iamCredentialsEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(iamCredentialsEndpoint))
+	}
+	service, err := iamcredentials.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		service:         service,
+		targetPrincipal: settings.ImpersonateServiceAccount,
+		delegates:       settings.ImpersonateDelegates,
+		scopes:          routes[routePath].scopes,
+	}), nil
+}
+
+// newImpersonatedTokenProvider returns a provider of tokens of the service account impersonated by the data source
+func newImpersonatedTokenProvider(settings types.BigQuerySettings, routePath string) (*tokenSourceProvider, error) {
+	if err := validateImpersonationSettings(settings); err != nil {
+		return nil, err
+	}
+
+	return cachedTokenProvider(settings, routePath, func() (oauth2.TokenSource, error) {
+		return newImpersonatingTokenSource(baseTokenSource(settings), settings, routePath)
+	})
+}
@@ -0,0 +1,117 @@
+package bigquery
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func testPrivateKey(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+func Test_newImpersonatedTokenProvider(t *testing.T) {
+	t.Run("requires the service account to impersonate", func(t *testing.T) {
+		_, err := getTokenProvider(types.BigQuerySettings{AuthenticationType: "impersonate", DefaultProject: "raintank-dev"}, bigQueryRoute)
+		assert.ErrorContains(t, err, "service account to impersonate")
+	})
+
+	t.Run("mints tokens of the target service account with the base credentials", func(t *testing.T) {
+		tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, r.ParseForm())
+			assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.Form.Get("grant_type"))
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"access_token":"base-token","token_type":"Bearer","expires_in":3600}`))
+		}))
+		defer tokenServer.Close()
+
+		var calls int32
+		iamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			assert.Equal(t, "Bearer base-token", r.Header.Get("Authorization"))
+			assert.Equal(t, "/v1/projects/-/serviceAccounts/target@raintank-dev.iam.gserviceaccount.com:generateAccessToken", r.URL.Path)
+
+			var body struct {
+				Delegates []string `json:"delegates"`
+				Scope     []string `json:"scope"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, []string{"projects/-/serviceAccounts/delegate@raintank-dev.iam.gserviceaccount.com"}, body.Delegates)
+			assert.Equal(t, routes[bigQueryRoute].scopes, body.Scope)
+
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"accessToken": "impersonated-token",
+				"expireTime":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			})
+		}))
+		defer iamServer.Close()
+
+		iamCredentialsEndpoint = iamServer.URL + "/"
+		defer func() { iamCredentialsEndpoint = "" }()
+
+		settings := types.BigQuerySettings{
+			DatasourceId:              42,
+			Updated:                   time.Now(),
+			AuthenticationType:        "impersonate",
+			DefaultProject:            "raintank-dev",
+			ClientEmail:               "base@raintank-dev.iam.gserviceaccount.com",
+			PrivateKey:                testPrivateKey(t),
+			TokenUri:                  tokenServer.URL,
+			ImpersonateServiceAccount: "target@raintank-dev.iam.gserviceaccount.com",
+			ImpersonateDelegates:      []string{"delegate@raintank-dev.iam.gserviceaccount.com"},
+		}
+
+		provider, err := getTokenProvider(settings, bigQueryRoute)
+		require.NoError(t, err)
+		token, err := provider.GetAccessToken(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "impersonated-token", token)
+
+		// tokens are reused by the providers of the same settings until they expire
+		provider, err = getTokenProvider(settings, bigQueryRoute)
+		require.NoError(t, err)
+		token, err = provider.GetAccessToken(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "impersonated-token", token)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+}
+
+func Test_evictStaleTokenSources(t *testing.T) {
+	before, after := time.Unix(1700000000, 0), time.Unix(1700000060, 0)
+	newTokenSource := func() (oauth2.TokenSource, error) {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), nil
+	}
+
+	_, err := cachedTokenProvider(types.BigQuerySettings{DatasourceId: 7, Updated: before}, bigQueryRoute, newTokenSource)
+	require.NoError(t, err)
+	_, err = cachedTokenProvider(types.BigQuerySettings{DatasourceId: 70, Updated: before}, bigQueryRoute, newTokenSource)
+	require.NoError(t, err)
+	_, err = cachedTokenProvider(types.BigQuerySettings{DatasourceId: 7, Updated: after}, bigQueryRoute, newTokenSource)
+	require.NoError(t, err)
+
+	_, staleExists := tokenSources.Load(fmt.Sprintf("7@%d/%s", before.UnixMilli(), bigQueryRoute))
+	assert.False(t, staleExists, "token sources of previous settings must be evicted")
+	_, currentExists := tokenSources.Load(fmt.Sprintf("7@%d/%s", after.UnixMilli(), bigQueryRoute))
+	assert.True(t, currentExists)
+	_, otherExists := tokenSources.Load(fmt.Sprintf("70@%d/%s", before.UnixMilli(), bigQueryRoute))
+	assert.True(t, otherExists, "token sources of other data sources must be kept")
+}
@@ -0,0 +1,45 @@
+package bigquery
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/cloudresourcemanager/v3"
+)
+
+// resourceManagerServices caches the Resource Manager service of each data source. Services are
+// keyed by the data source ID and the time its settings were last updated, so that a service created
+// with rotated or changed credentials replaces the stale one. It is safe for concurrent use.
+type resourceManagerServices struct {
+	mu       sync.RWMutex
+	services map[string]*cloudresourcemanager.Service
+}
+
+func resourceManagerKey(datasourceID string, updated time.Time) string {
+	return fmt.Sprintf("%s@%d", datasourceID, updated.UnixMilli())
+}
+
+// get returns the service of a data source for the given settings update, or nil if there is none yet
+func (r *resourceManagerServices) get(datasourceID string, updated time.Time) *cloudresourcemanager.Service {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.services[resourceManagerKey(datasourceID, updated)]
+}
+
+// set stores the service of a data source, removing the services of its previous settings
+func (r *resourceManagerServices) set(datasourceID string, updated time.Time, service *cloudresourcemanager.Service) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.services == nil {
+		r.services = map[string]*cloudresourcemanager.Service{}
+	}
+	for key := range r.services {
+		if strings.HasPrefix(key, datasourceID+"@") {
+			delete(r.services, key)
+		}
+	}
+	r.services[resourceManagerKey(datasourceID, updated)] = service
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 
+	bq "cloud.google.com/go/bigquery"
 	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
 	"github.com/grafana/grafana-google-sdk-go/pkg/utils"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -11,6 +12,9 @@ import (
 
 // Settings - data loaded from grafana settings database
 
+// defaultRowLimit is the row limit of data sources which don't set one, the default SQL row limit of Grafana
+const defaultRowLimit = 1000000
+
 type Credentials struct {
 	Type        string `json:"type"`
 	ProjectID   string `json:"project_id"`
@@ -32,6 +36,8 @@ func loadSettings(config *backend.DataSourceInstanceSettings) (types.BigQuerySet
 		return settings, err
 	}
 
+	settings.ExternalAccountConfig = config.DecryptedSecureJSONData["externalAccountConfig"]
+
 	settings.DatasourceId = config.ID
 	settings.Updated = config.Updated
 
@@ -39,14 +45,34 @@ func loadSettings(config *backend.DataSourceInstanceSettings) (types.BigQuerySet
 		settings.ProcessingLocation = "US"
 	}
 
+	if settings.QueryPriority == "" {
+		settings.QueryPriority = string(bq.InteractivePriority)
+	}
+
+	if settings.RowLimit <= 0 {
+		settings.RowLimit = defaultRowLimit
+	}
+
 	return settings, nil
 }
 
 func getConnectionSettings(settings types.BigQuerySettings, queryArgs *ConnectionArgs) types.ConnectionSettings {
 	connectionSettings := types.ConnectionSettings{
-		Project:            settings.DefaultProject,
-		Location:           settings.ProcessingLocation,
-		AuthenticationType: settings.AuthenticationType,
+		Project:             settings.DefaultProject,
+		Location:            settings.ProcessingLocation,
+		AuthenticationType:  settings.AuthenticationType,
+		QueryPriority:       settings.QueryPriority,
+		JobProject:          settings.FlatRateProject,
+		MaxBytesBilled:      settings.MaxBytesBilled,
+		PreflightBytesLimit: settings.PreflightBytesLimit,
+		JobLabels:           settings.JobLabels,
+		LosslessNumeric:     settings.LosslessNumeric,
+		UnnestArrays:        settings.UnnestArrays,
+		TimeZone:            settings.TimeZone,
+		GeoJSON:             settings.GeoJSON,
+		StorageReadRows:     settings.StorageReadRows,
+		StorageReadBytes:    settings.StorageReadBytes,
+		RowLimit:            settings.RowLimit,
 	}
 
 	if queryArgs.Location != "" {
@@ -57,5 +83,18 @@ func getConnectionSettings(settings types.BigQuerySettings, queryArgs *Connectio
 		connectionSettings.Dataset = queryArgs.Dataset
 	}
 
+	// queries can only lower the limit set on the data source
+	if queryArgs.MaxBytesBilled > 0 {
+		if connectionSettings.MaxBytesBilled > 0 {
+			connectionSettings.MaxBytesBilled = min(connectionSettings.MaxBytesBilled, queryArgs.MaxBytesBilled)
+		} else {
+			connectionSettings.MaxBytesBilled = queryArgs.MaxBytesBilled
+		}
+	}
+
+	if queryArgs.UnnestArrays != "" {
+		connectionSettings.UnnestArrays = queryArgs.UnnestArrays
+	}
+
 	return connectionSettings
 }
@@ -0,0 +1,41 @@
+package bigquery
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-bigquery-datasource/pkg/bigquery/types"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_getConnectionSettings_maxBytesBilled(t *testing.T) {
+	tests := []struct {
+		name       string
+		datasource int64
+		query      int64
+		expected   int64
+	}{
+		{name: "uses the limit of the data source", datasource: 1000, expected: 1000},
+		{name: "lets queries lower the limit", datasource: 1000, query: 500, expected: 500},
+		{name: "doesn't let queries raise the limit", datasource: 1000, query: 5000, expected: 1000},
+		{name: "uses the limit of the query without a data source limit", query: 5000, expected: 5000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := getConnectionSettings(types.BigQuerySettings{MaxBytesBilled: tt.datasource}, &ConnectionArgs{MaxBytesBilled: tt.query})
+			assert.Equal(t, tt.expected, settings.MaxBytesBilled)
+		})
+	}
+}
+
+func Test_loadSettings_rowLimit(t *testing.T) {
+	settings, err := loadSettings(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	require.NoError(t, err)
+	assert.Equal(t, int64(defaultRowLimit), settings.RowLimit)
+
+	settings, err = loadSettings(&backend.DataSourceInstanceSettings{JSONData: []byte(`{"rowLimit":5000}`)})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5000), settings.RowLimit)
+	assert.Equal(t, int64(5000), getConnectionSettings(settings, &ConnectionArgs{}).RowLimit)
+}
@@ -17,9 +17,37 @@ type BigQuerySettings struct {
 	Updated            time.Time
 	AuthenticationType string `json:"authenticationType"`
 	PrivateKeyPath     string `json:"privateKeyPath"`
+	MaxBytesBilled     int64  `json:"maxBytesBilled"`
+	// PreflightBytesLimit enables a dry run of every query, refusing to run those which would process more bytes
+	PreflightBytesLimit int64 `json:"preflightBytesLimit"`
+	// JobLabels are static labels attached to every query job, next to the labels identifying the request
+	JobLabels map[string]string `json:"jobLabels"`
+	// LosslessNumeric returns NUMERIC and BIGNUMERIC columns as decimal strings rather than float64
+	LosslessNumeric bool `json:"losslessNumeric"`
+	// UnnestArrays expands the first array column of results, see UnnestRows and UnnestColumns
+	UnnestArrays string `json:"unnestArrays"`
+	// TimeZone is the IANA time zone DATE and DATETIME values are in, UTC if empty
+	TimeZone string `json:"timeZone"`
+	// GeoJSON converts GEOGRAPHY columns to GeoJSON, with the latitude and longitude of points
+	GeoJSON bool `json:"geoJson"`
+	// RowLimit is the number of rows of a result that are read in memory at once, when unnesting arrays into
+	// columns or reading with the Storage Read API
+	RowLimit int64 `json:"rowLimit"`
+	// StorageReadRows reads results of at least this many rows with the Storage Read API, disabled if 0
+	StorageReadRows int64 `json:"storageReadRows"`
+	// StorageReadBytes reads results of at least this many bytes with the Storage Read API, disabled if 0
+	StorageReadBytes int64 `json:"storageReadBytes"`
+	// ImpersonateServiceAccount is the service account impersonated with the impersonate authentication type.
+	// Its tokens are minted with the service account key of the data source if set, the GCE credentials otherwise.
+	// With the externalAccount authentication type, it is optionally impersonated with the external account.
+	ImpersonateServiceAccount string `json:"impersonateServiceAccount"`
+	// ImpersonateDelegates is the optional delegation chain of service accounts leading to the impersonated one
+	ImpersonateDelegates []string `json:"impersonateDelegates"`
 
 	// Saved in secure JSON
 	PrivateKey string `json:"-"`
+	// ExternalAccountConfig is the external_account credential configuration of the externalAccount authentication type
+	ExternalAccountConfig string `json:"-"`
 }
 
 type ConnectionSettings struct {
@@ -27,7 +55,29 @@ type ConnectionSettings struct {
 	Location           string
 	Project            string
 	Dataset            string
+	QueryPriority      string
+	// JobProject is the project query jobs are created (and billed) in, e.g. a flat-rate project
+	JobProject          string
+	MaxBytesBilled      int64
+	PreflightBytesLimit int64
+	JobLabels           map[string]string
+	LosslessNumeric     bool
+	UnnestArrays        string
+	TimeZone            string
+	GeoJSON             bool
+	StorageReadRows     int64
+	StorageReadBytes    int64
+	RowLimit            int64
 }
+
+// Modes of expanding the first array column of a result. Results without an array column aren't changed.
+const (
+	// UnnestRows emits a row per element of the array, repeating the other columns
+	UnnestRows = "rows"
+	// UnnestColumns emits a column per index of the array, up to the longest array of the result
+	UnnestColumns = "columns"
+)
+
 type TableFieldSchema struct {
 	Name        string       `json:"name"`
 	Description string       `json:"description,omitempty"`